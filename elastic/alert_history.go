@@ -0,0 +1,124 @@
+package elastic
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// Document type of alert history documents
+const alertHistoryDocType = "alert"
+
+// What happened to an alert, as recorded in the alert history
+const (
+	historyStatusFired      = "fired"
+	historyStatusResolved   = "resolved"
+	historyStatusSuppressed = "suppressed"
+	historyStatusThrottled  = "throttled"
+	historyStatusOK         = "ok"
+	historyStatusError      = "error"
+)
+
+// A document in the alert history index. One is written for every
+// notification, and for every rule evaluation that didn't send one.
+type alertHistory struct {
+	Timestamp     int64              `json:"timestamp"`
+	Key           string             `json:"alert_key"`
+	Status        string             `json:"status"`
+	ClusterName   string             `json:"cluster_name"`
+	RuleName      string             `json:"rule_name,omitempty"`
+	QueryKeyValue string             `json:"query_key_value,omitempty"`
+	Severity      string             `json:"severity,omitempty"`
+	Value         float64            `json:"value"`
+	Threshold     float64            `json:"threshold"`
+	Operator      string             `json:"operator,omitempty"`
+	Message       string             `json:"message,omitempty"`
+	SilenceID     string             `json:"silence_id,omitempty"`
+	Notifiers     []notifierDelivery `json:"notifiers,omitempty"`
+	Delivered     bool               `json:"delivered"`
+	LatencyMillis int64              `json:"latency_ms"`
+}
+
+// The result of sending a notification with one notifier
+type notifierDelivery struct {
+	Notifier      string `json:"notifier"`
+	Success       bool   `json:"success"`
+	Error         string `json:"error,omitempty"`
+	LatencyMillis int64  `json:"latency_ms"`
+}
+
+func alertHistoryFor(alert alertNotification, status string) alertHistory {
+	return alertHistory{
+		Timestamp:     getCurrentTimeInMills(),
+		Key:           alert.Key,
+		Status:        status,
+		ClusterName:   alert.ClusterName,
+		RuleName:      alert.RuleName,
+		QueryKeyValue: alert.QueryKeyValue,
+		Severity:      alert.Severity,
+		Value:         alert.Value,
+		Threshold:     alert.Threshold,
+		Operator:      alert.Operator,
+		Message:       alert.Message,
+	}
+}
+
+// Builds the history of a rule evaluation that didn't send a notification
+func ruleEvaluationHistory(rule *notificationRule, result ruleResult, status string) alertHistory {
+	key := ruleAlertKey(rule.Name)
+	if result.QueryKeyValue != "" {
+		key = ruleQueryKeyAlertKey(rule.Name, result.QueryKeyValue)
+	}
+
+	return alertHistory{
+		Timestamp:     getCurrentTimeInMills(),
+		Key:           key,
+		Status:        status,
+		ClusterName:   rule.ClusterName,
+		RuleName:      rule.Name,
+		QueryKeyValue: result.QueryKeyValue,
+		Severity:      rule.Severity,
+		Value:         result.Value,
+		Threshold:     rule.Threshold,
+		Operator:      rule.Operator,
+		Message:       result.Description,
+	}
+}
+
+// Adds a notifier's result. The alert counts as delivered if every
+// notifier it was sent with succeeded.
+func (history *alertHistory) addDelivery(notifier string, err error, latency time.Duration) {
+	delivery := notifierDelivery{
+		Notifier:      notifier,
+		Success:       err == nil,
+		LatencyMillis: int64(latency / time.Millisecond),
+	}
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+
+	history.Delivered = delivery.Success && (len(history.Notifiers) == 0 || history.Delivered)
+	history.LatencyMillis += delivery.LatencyMillis
+	history.Notifiers = append(history.Notifiers, delivery)
+}
+
+// Queues the document to be indexed in the day's alert history index
+func recordAlertHistory(history alertHistory) {
+	document, err := json.Marshal(history)
+	if err != nil {
+		log.Print("Error building alert history: ", err)
+		return
+	}
+
+	addToIndexQueue(alertHistoryIndex(time.Now()), alertHistoryDocType, string(document))
+}
+
+func alertHistoryIndex(now time.Time) string {
+	var indexBuffer bytes.Buffer
+	indexBuffer.WriteString(configuration.IndexPrefix)
+	indexBuffer.WriteString("-alerts")
+	indexBuffer.WriteString(now.Format("-2006.01.02"))
+
+	return indexBuffer.String()
+}
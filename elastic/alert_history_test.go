@@ -0,0 +1,101 @@
+package elastic
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Sends the alert with a queue to catch the history document in, and
+// returns the document
+func sendAndReadHistory(t *testing.T, alert alertNotification) alertHistory {
+	retryQueue = make(chan indexQueueItem, 10)
+	defer func() { retryQueue = nil }()
+
+	sendNotification(alert)
+
+	select {
+	case item := <-retryQueue:
+		if item.Index != alertHistoryIndex(time.Now()) {
+			t.Fail()
+			t.Logf("History should be written to the alerts index, was %v", item.Index)
+		}
+
+		var history alertHistory
+		err := json.Unmarshal([]byte(item.Payload), &history)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return history
+	default:
+		t.Fatal("No alert history was queued")
+	}
+
+	return alertHistory{}
+}
+
+func TestAlertHistoryDelivery(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	configuration.Notifications = []string{"webhook"}
+	configuration.DefaultWebhookURI = server.URL
+	defer func() {
+		configuration.Notifications = nil
+		configuration.DefaultWebhookURI = ""
+	}()
+
+	history := sendAndReadHistory(t, alertNotification{Key: ruleAlertKey("errors"), Status: alertStateFiring,
+		ClusterName: "prod", RuleName: "errors", Value: 12, Threshold: 10, Operator: ">", Timestamp: time.Now()})
+
+	if history.Status != historyStatusFired || history.RuleName != "errors" || history.Value != 12 {
+		t.Fail()
+		t.Logf("History should describe the fired alert, was %+v", history)
+	}
+
+	if len(history.Notifiers) != 1 || history.Notifiers[0].Notifier != "webhook" || history.Notifiers[0].Success {
+		t.Fail()
+		t.Logf("History should record the failed webhook, was %+v", history.Notifiers)
+	}
+
+	if history.Delivered {
+		t.Fail()
+		t.Logf("An alert whose notifier failed should not be delivered")
+	}
+}
+
+func TestAlertHistorySuppressed(t *testing.T) {
+	configuration.Silences = []silence{{ID: "maintenance", ClusterName: "prod", EndsAt: time.Now().Add(time.Hour)}}
+	defer func() { configuration.Silences = nil }()
+
+	history := sendAndReadHistory(t, alertNotification{Status: alertStateFiring, ClusterName: "prod", Timestamp: time.Now()})
+
+	if history.Status != historyStatusSuppressed || history.SilenceID != "maintenance" {
+		t.Fail()
+		t.Logf("History should record the silence, was %+v", history)
+	}
+}
+
+func TestAlertHistoryDelivered(t *testing.T) {
+	var history alertHistory
+	history.addDelivery("slack", nil, time.Millisecond*20)
+	history.addDelivery("email", nil, time.Millisecond*30)
+
+	if !history.Delivered || history.LatencyMillis != 50 {
+		t.Fail()
+		t.Logf("Every notifier succeeded so the alert should be delivered, was %+v", history)
+	}
+
+	history.addDelivery("pagerduty", errors.New("timeout"), time.Second)
+	history.addDelivery("webhook", nil, 0)
+
+	if history.Delivered {
+		t.Fail()
+		t.Logf("One notifier failed so the alert should not be delivered")
+	}
+}
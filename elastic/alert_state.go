@@ -0,0 +1,60 @@
+package elastic
+
+import (
+	"time"
+)
+
+const (
+	alertStateOK       = "ok"
+	alertStateFiring   = "firing"
+	alertStateResolved = "resolved"
+)
+
+// Tracks whether a cluster check or rule has an open incident.
+// Alerts move from ok to firing when a notification is sent, and from
+// firing to resolved once the condition clears.
+type alertState struct {
+	State       string
+	FiringSince time.Time
+	ResolvedAt  time.Time
+
+	// Severity of the last firing notification, so the resolved one
+	// is routed to the same notifiers
+	Severity string
+}
+
+// Marks the alert as firing. since is when the condition started.
+// Returns true if the alert was not already firing.
+func (alert *alertState) fire(since time.Time) bool {
+	if alert.isFiring() {
+		return false
+	}
+
+	alert.State = alertStateFiring
+	alert.FiringSince = since
+	return true
+}
+
+// Marks a firing alert as resolved and returns how long it was firing.
+// Returns false if the alert was not firing.
+func (alert *alertState) resolve(now time.Time) (time.Duration, bool) {
+	if !alert.isFiring() {
+		if alert.State == "" {
+			alert.State = alertStateOK
+		}
+		return 0, false
+	}
+
+	alert.State = alertStateResolved
+	alert.ResolvedAt = now
+	return now.Sub(alert.FiringSince), true
+}
+
+func (alert *alertState) isFiring() bool {
+	return alert.State == alertStateFiring
+}
+
+// Rounds the incident length to the second for notification messages
+func formatIncidentDuration(duration time.Duration) string {
+	return duration.Round(time.Second).String()
+}
@@ -0,0 +1,58 @@
+package elastic
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAlertStateFiresOnce(t *testing.T) {
+	var alert alertState
+
+	if !alert.fire(time.Now()) {
+		t.Fail()
+		t.Logf("First fire should open the incident")
+	}
+
+	if alert.fire(time.Now()) {
+		t.Fail()
+		t.Logf("Alert that is already firing should not fire again")
+	}
+}
+
+func TestAlertStateResolve(t *testing.T) {
+	var alert alertState
+
+	if _, resolved := alert.resolve(time.Now()); resolved {
+		t.Fail()
+		t.Logf("Alert that never fired should not resolve")
+	}
+
+	if alert.State != alertStateOK {
+		t.Fail()
+		t.Logf("Alert state should be %v, was %v", alertStateOK, alert.State)
+	}
+
+	firingSince := time.Now().Add(time.Minute * -5)
+	alert.fire(firingSince)
+
+	duration, resolved := alert.resolve(firingSince.Add(time.Minute * 5))
+	if !resolved {
+		t.Fail()
+		t.Logf("Firing alert should resolve")
+	}
+
+	if duration != time.Minute*5 {
+		t.Fail()
+		t.Logf("Incident length should be %v, was %v", time.Minute*5, duration)
+	}
+
+	if alert.State != alertStateResolved {
+		t.Fail()
+		t.Logf("Alert state should be %v, was %v", alertStateResolved, alert.State)
+	}
+
+	if _, resolved := alert.resolve(time.Now()); resolved {
+		t.Fail()
+		t.Logf("Resolved alert should not resolve again")
+	}
+}
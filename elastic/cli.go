@@ -0,0 +1,275 @@
+package elastic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// A query a rule sends, named for printing
+type namedQuery struct {
+	Name  string
+	Query []byte
+}
+
+// Validate checks the configuration and every rule file without connecting to any
+// cluster. Every problem found is returned, rather than only the first.
+func Validate() []error {
+	err := readConfiguration(startupOptions.ConfigFile)
+	if err != nil {
+		return []error{err}
+	}
+
+	errs := validateConfiguration()
+
+	paths, err := ruleFiles()
+	if err != nil {
+		return append(errs, fmt.Errorf("error reading rules folder: %v", err))
+	}
+
+	rulePaths := map[string]string{}
+	for _, path := range paths {
+		rule, err := readRuleFile(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if rule.Name == "" {
+			errs = append(errs, fmt.Errorf("rule file %v has no name", path))
+			continue
+		}
+
+		// Rules are tracked by name, so two with the same name would share state
+		if otherPath, ok := rulePaths[rule.Name]; ok {
+			errs = append(errs, fmt.Errorf("rule file %v has the same name as %v: %v", path, otherPath, rule.Name))
+			continue
+		}
+		rulePaths[rule.Name] = path
+	}
+
+	return errs
+}
+
+// TestRule runs a rule file's query against its cluster and writes the
+// query, the result, whether the rule would fire and its notification to
+// out. Nothing is sent and no state is changed.
+func TestRule(path string, out io.Writer) error {
+	err := readConfiguration(startupOptions.ConfigFile)
+	if err != nil {
+		return err
+	}
+
+	if errs := validateConfiguration(); len(errs) > 0 {
+		return errs[0]
+	}
+	configureHostClients()
+
+	rule, err := readRuleFile(path)
+	if err != nil {
+		return err
+	}
+
+	hosts := clusterHosts(rule.ClusterName)
+	if len(hosts) == 0 {
+		return fmt.Errorf("no cluster configuration could be found for %v", rule.ClusterName)
+	}
+
+	version := versionForRuleCluster(rule.ClusterName)
+
+	fmt.Fprintf(out, "Rule: %v (%v) on %v\n", rule.Name, rule.Type, rule.ClusterName)
+	fmt.Fprintf(out, "URL: %v\n", buildRuleURL(&rule, version))
+
+	queries, err := ruleQueries(&rule, version)
+	if err != nil {
+		return fmt.Errorf("error building query: %v", err)
+	}
+	for _, query := range queries {
+		fmt.Fprintf(out, "%v:\n%v\n", query.Name, indentQuery(query.Query))
+	}
+
+	if rule.Type == "new_term" {
+		return testNewTermRule(&rule, hosts, version, out)
+	}
+
+	var results []ruleResult
+	if rule.QueryKey != "" {
+		results, err = evaluateGroupedRule(&rule, hosts, version)
+		if err == nil && len(results) == 0 {
+			fmt.Fprintf(out, "\nNo values of %v had matching documents\n", rule.QueryKey)
+		}
+	} else {
+		var result ruleResult
+		result, err = evaluateRule(&rule, hosts, version)
+		results = []ruleResult{result}
+	}
+	if err != nil {
+		return fmt.Errorf("error running query: %v", err)
+	}
+
+	for _, result := range results {
+		fires := !result.NoValue && evaluateOperator(rule.Operator, result.Value, rule.Threshold)
+
+		fmt.Fprintln(out)
+		if result.QueryKeyValue != "" {
+			fmt.Fprintf(out, "%v: %v\n", rule.QueryKey, result.QueryKeyValue)
+		}
+		fmt.Fprintf(out, "Result: %v\n", result.Description)
+		fmt.Fprintf(out, "Threshold: %v %v\n", rule.Operator, formatAlertValue(rule.Threshold))
+		fmt.Fprintf(out, "Would fire: %v\n", describeWouldFire(&rule, fires))
+
+		message, _ := buildRuleMessage(&rule, result, alertStateFiring,
+			fmt.Sprintf("%v %v", rule.NotificationMessage, describeRuleResult(&rule, result)), "%v")
+		fmt.Fprintf(out, "Notification: %v\n", message)
+	}
+
+	return nil
+}
+
+func describeWouldFire(rule *notificationRule, fires bool) string {
+	if !fires {
+		return "no"
+	}
+	if rule.Type == "flatline" {
+		return fmt.Sprintf("yes, once it has been under the threshold for %v minutes", rule.FlatlineDuration)
+	}
+	return "yes"
+}
+
+// Compares the values of the rule's field in the last run's window with
+// the ones before it in the lookback window, as the rule would once it has
+// learned them
+func testNewTermRule(rule *notificationRule, hosts []string, version clusterVersion, out io.Writer) error {
+	lookback := rule.NewTermLookback
+	if lookback <= 0 {
+		lookback = defaultNewTermLookback
+	}
+
+	window := rule.Interval * 2
+	if window < 1 {
+		window = 1
+	}
+
+	known, err := queryTerms(rule, hosts, version,
+		timeWindow{From: fmt.Sprintf("now-%vd", lookback), To: fmt.Sprintf("now-%vm", window)})
+	if err != nil {
+		return fmt.Errorf("error running query: %v", err)
+	}
+
+	recent, err := queryTerms(rule, hosts, version, timeWindow{From: fmt.Sprintf("now-%vm", window), To: "now"})
+	if err != nil {
+		return fmt.Errorf("error running query: %v", err)
+	}
+
+	learned := &knownTerms{Field: rule.NewTermField, Terms: map[string]time.Time{}}
+	learned.add(known, time.Now())
+	newTerms := learned.add(recent, time.Now())
+
+	fmt.Fprintf(out, "\nKnown values of %v: %v\n", rule.NewTermField, len(known))
+	fmt.Fprintf(out, "Values in the last %v minutes: %v\n", window, len(recent))
+
+	if len(newTerms) == 0 {
+		fmt.Fprintln(out, "Would fire: no")
+		return nil
+	}
+
+	result := ruleResult{
+		Value:       float64(len(newTerms)),
+		Description: fmt.Sprintf("New values for %v: %v", rule.NewTermField, strings.Join(newTerms, ", ")),
+	}
+	for _, term := range newTerms {
+		result.Buckets = append(result.Buckets, notificationBucket{Key: term})
+	}
+
+	message, _ := buildRuleMessage(rule, result, alertStateFiring,
+		fmt.Sprintf("%v %v", rule.NotificationMessage, result.Description), "%v")
+
+	fmt.Fprintln(out, "Would fire: yes")
+	fmt.Fprintf(out, "Notification: %v\n", message)
+	return nil
+}
+
+// Returns the queries the rule sends each time it runs
+func ruleQueries(rule *notificationRule, version clusterVersion) ([]namedQuery, error) {
+	timestampField := rule.TimestampField
+	if timestampField == "" {
+		timestampField = defaultTimestampField
+	}
+
+	switch {
+	case rule.Type == "new_term":
+		window := rule.Interval * 2
+		if window < 1 {
+			window = 1
+		}
+
+		query, err := buildNewTermQuery(rule, timeWindow{From: fmt.Sprintf("now-%vm", window), To: "now"}, version, nil)
+		return []namedQuery{{"Query", query}}, err
+
+	case rule.QueryKey != "":
+		query, err := buildGroupedQuery(rule)
+		return []namedQuery{{"Query", query}}, err
+
+	case usesAggregation(rule):
+		query, err := buildMetricQuery(rule.Query, rule.Aggregation)
+		return []namedQuery{{"Query", query}}, err
+
+	case rule.Type == "search":
+		query, err := buildSearchQuery(rule.Query, version)
+		return []namedQuery{{"Query", query}}, err
+
+	case rule.Type == "ratio":
+		return []namedQuery{{"Numerator query", rule.NumeratorQuery}, {"Denominator query", rule.DenominatorQuery}}, nil
+
+	case rule.Type == "spike":
+		current, reference := spikeWindows(rule.SpikeTimeframe, rule.SpikeReference)
+
+		currentQuery, err := buildWindowQuery(rule.Query, timestampField, current)
+		if err != nil {
+			return nil, err
+		}
+
+		referenceQuery, err := buildWindowQuery(rule.Query, timestampField, reference)
+		return []namedQuery{{"Current query", currentQuery}, {"Reference query", referenceQuery}}, err
+	}
+
+	return []namedQuery{{"Query", rule.Query}}, nil
+}
+
+func indentQuery(query []byte) string {
+	var indented bytes.Buffer
+	err := json.Indent(&indented, query, "", "  ")
+	if err != nil {
+		return string(query)
+	}
+	return indented.String()
+}
+
+// RunOnce collects every cluster and runs every enabled rule a single time,
+// then sends what was collected and returns
+func RunOnce() {
+	loadConfiguration()
+	detectClusterVersions()
+	initializeClusterHealthTracking()
+	initializeClusterCollectors()
+	loadNotificationRules()
+	loadSilences()
+	openIndexSpool()
+	retryQueue = make(chan indexQueueItem, indexQueueCapacity)
+
+	// Rules the daemon or an earlier run has run within their interval are
+	// still run
+	notificationRulesLock.Lock()
+	for i := range notificationRules {
+		notificationRules[i].LastProcessedTime = time.Time{}
+	}
+	notificationRulesLock.Unlock()
+
+	// Collections that passed the deadline can still be queueing documents,
+	// so they are waited for before the queue is drained
+	doMonitor().Wait()
+	drainIndexQueue()
+}
@@ -0,0 +1,202 @@
+package elastic
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Runs test in a folder with the given gwylio.yml and rule files
+func inConfigurationFolder(t *testing.T, config string, rules map[string]string, test func()) {
+	folder, err := ioutil.TempDir("", "gwylio-cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	err = ioutil.WriteFile(filepath.Join(folder, "gwylio.yml"), []byte(config), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Mkdir(filepath.Join(folder, "rules"), 0755)
+	for name, rule := range rules {
+		err = ioutil.WriteFile(filepath.Join(folder, "rules", name), []byte(rule), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	workingFolder, _ := os.Getwd()
+	os.Chdir(folder)
+	defer func() {
+		os.Chdir(workingFolder)
+		configuration = options{}
+	}()
+
+	test()
+}
+
+const testCountRule = `{
+	"rule_name": "Server errors",
+	"rule_type": "count",
+	"notification_message": "Too many server errors",
+	"cluster_name": "prod",
+	"index_name": "logs-*",
+	"enabled": true,
+	"operator": ">",
+	"threshold": 100,
+	"query": {"query": {"match": {"status": 500}}}
+}`
+
+func TestValidateCollectsEveryProblem(t *testing.T) {
+	config := `
+elastic_clients_from:
+  - cluster_name: "prod"
+    hosts: ["http://localhost:9200"]
+notification_routing:
+  urgent: ["slack"]
+`
+	rules := map[string]string{
+		"good.json":      testCountRule,
+		"duplicate.json": testCountRule,
+		"metric.json":    `{"rule_name": "Latency", "rule_type": "metric", "cluster_name": "prod", "enabled": true}`,
+		"broken.json":    `{"rule_name": `,
+	}
+
+	inConfigurationFolder(t, config, rules, func() {
+		errs := Validate()
+
+		var messages []string
+		for _, err := range errs {
+			messages = append(messages, err.Error())
+		}
+		all := strings.Join(messages, "\n")
+
+		for _, expected := range []string{"notification_routing", "metric.json", "broken.json", "same name"} {
+			if !strings.Contains(all, expected) {
+				t.Fail()
+				t.Logf("Validate should report a problem with %v, reported:\n%v", expected, all)
+			}
+		}
+
+		if len(errs) != 4 {
+			t.Fail()
+			t.Logf("Validate should report 4 problems, reported:\n%v", all)
+		}
+	})
+}
+
+func TestTestRule(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/_count") {
+			fmt.Fprintln(w, `{"count": 150}`)
+			return
+		}
+		fmt.Fprintln(w, `{"version":{"number":"7.10.0"}}`)
+	}))
+	defer server.Close()
+
+	config := fmt.Sprintf(`
+elastic_clients_from:
+  - cluster_name: "prod"
+    hosts: ["%v"]
+`, server.URL)
+
+	inConfigurationFolder(t, config, map[string]string{"errors.json": testCountRule}, func() {
+		var out bytes.Buffer
+		err := TestRule(filepath.Join("rules", "errors.json"), &out)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, expected := range []string{"logs-*/_count", `"status": 500`, "Would fire: yes",
+			"Notification: Too many server errors Result count was 150"} {
+
+			if !strings.Contains(out.String(), expected) {
+				t.Fail()
+				t.Logf("test-rule output should contain %v, was:\n%v", expected, out.String())
+			}
+		}
+	})
+}
+
+func TestValidateRejectsUnknownRuleTypeAndOperator(t *testing.T) {
+	config := `
+elastic_clients_from:
+  - cluster_name: "prod"
+    hosts: ["http://localhost:9200"]
+`
+	rules := map[string]string{
+		"type.json":     strings.Replace(testCountRule, `"rule_type": "count"`, `"rule_type": "cuont"`, 1),
+		"operator.json": strings.Replace(testCountRule, `"operator": ">"`, `"operator": "greater"`, 1),
+	}
+
+	inConfigurationFolder(t, config, rules, func() {
+		errs := Validate()
+
+		var messages []string
+		for _, err := range errs {
+			messages = append(messages, err.Error())
+		}
+		all := strings.Join(messages, "\n")
+
+		for _, expected := range []string{`unknown rule_type "cuont"`, `unknown operator "greater"`} {
+			if !strings.Contains(all, expected) {
+				t.Fail()
+				t.Logf("Validate should report %v, reported:\n%v", expected, all)
+			}
+		}
+	})
+}
+
+func TestRunOnceRunsEveryRule(t *testing.T) {
+	var counts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/_count") {
+			atomic.AddInt32(&counts, 1)
+			fmt.Fprintln(w, `{"count": 0}`)
+			return
+		}
+		fmt.Fprintln(w, `{"version":{"number":"7.10.0"}}`)
+	}))
+	defer server.Close()
+
+	config := fmt.Sprintf(`
+elastic_clients_from:
+  - cluster_name: "prod"
+    hosts: ["%v"]
+elastic_clients_to: ["%v"]
+state_directory: "state"
+spool_directory: "spool"
+collect_interval: 30
+`, server.URL, server.URL)
+
+	rule := strings.Replace(testCountRule, `"enabled": true,`, `"enabled": true, "interval": 60,`, 1)
+
+	inConfigurationFolder(t, config, map[string]string{"errors.json": rule}, func() {
+		defer func() {
+			notificationRules = nil
+			clusterCollectors = nil
+		}()
+
+		// The rule ran a minute ago, well within its interval
+		configuration.StateDirectory = "state"
+		saveRuleState(&notificationRule{Name: "Server errors", LastProcessedTime: time.Now().Add(-time.Minute)})
+
+		RunOnce()
+
+		if atomic.LoadInt32(&counts) != 1 {
+			t.Fail()
+			t.Logf("once should run every rule whatever its interval, the rule ran %v times", counts)
+		}
+	})
+}
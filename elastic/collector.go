@@ -0,0 +1,124 @@
+package elastic
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Collects stats for one cluster. Each cluster is collected in its own goroutine
+// with its own node list, so a slow cluster doesn't hold up the others.
+type clusterCollector struct {
+	Config  elasticHostConfig
+	Nodes   nodeTracker
+	Health  *clusterHealthMonitor
+	running int32
+
+	statusLock             sync.RWMutex
+	LastCollectionStart    time.Time
+	LastCollectionDuration time.Duration
+	LastCollectionErrors   []string
+}
+
+var clusterCollectors []*clusterCollector
+
+// Set while rules are being run so a long run isn't started again by the next cycle
+var rulesRunning int32
+
+var errCollectionDeadline = errors.New("collection deadline exceeded")
+
+func initializeClusterCollectors() {
+	for _, cluster := range configuration.ElasticClientsFrom {
+		collector := &clusterCollector{
+			Config: cluster,
+			Health: clusterHealthMonitorFor(cluster.ClusterName),
+		}
+		clusterCollectors = append(clusterCollectors, collector)
+	}
+}
+
+// Runs each step of a collection, stopping if the deadline passes
+func (collector *clusterCollector) collect(deadline time.Time) {
+	start := time.Now()
+	var collectionErrors []string
+
+	hosts := collector.Config.Hosts
+	steps := []func() error{
+		func() error {
+			versionForCluster(collector.Config.ClusterName, hosts)
+			return collector.Nodes.getNodeList(hosts)
+		},
+		func() error {
+			return queryClusterHealth(hosts, collector.Health, collector.Config.ExpectedNodeCount)
+		},
+		func() error {
+			return collector.Nodes.queryNodeStats(hosts)
+		},
+		func() error {
+			collector.Nodes.queryCatchupNodes(hosts)
+			return nil
+		},
+	}
+
+	for _, step := range steps {
+		if time.Now().After(deadline) {
+			collectionErrors = append(collectionErrors, errCollectionDeadline.Error())
+			log.Printf("Collection for %v stopped: %v", collector.Config.ClusterName, errCollectionDeadline)
+			break
+		}
+
+		err := step()
+		if err != nil {
+			collectionErrors = append(collectionErrors, err.Error())
+		}
+	}
+
+	collector.statusLock.Lock()
+	collector.LastCollectionStart = start
+	collector.LastCollectionDuration = time.Since(start)
+	collector.LastCollectionErrors = collectionErrors
+	collector.statusLock.Unlock()
+}
+
+// Starts a collection unless the last one for this cluster is still running.
+// Returns false if it was skipped.
+func (collector *clusterCollector) start(deadline time.Time, wg *sync.WaitGroup) bool {
+	if !atomic.CompareAndSwapInt32(&collector.running, 0, 1) {
+		log.Printf("Skipping collection for %v, the last one is still running", collector.Config.ClusterName)
+		return false
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer atomic.StoreInt32(&collector.running, 0)
+		collector.collect(deadline)
+	}()
+
+	return true
+}
+
+// How long a collection cycle can take before it is cut off
+func collectTimeout() time.Duration {
+	if configuration.CollectTimeout > 0 {
+		return time.Second * time.Duration(configuration.CollectTimeout)
+	}
+	return time.Second * time.Duration(configuration.CollectInterval)
+}
+
+// Waits for the running collections, giving up once the deadline has passed
+func waitForCollections(wg *sync.WaitGroup, deadline time.Time) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Until(deadline)):
+		log.Print("Collection cycle passed its deadline, running rules without waiting for it")
+	}
+}
@@ -0,0 +1,88 @@
+package elastic
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestClusterServer(clusterName string, delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		switch r.URL.Path {
+		case "/_cat/nodes":
+			fmt.Fprintln(w, "10.0.0.1 10.0.0.1 18 97 0.07 d * "+clusterName+"-node-1")
+		case "/_cluster/health":
+			fmt.Fprintf(w, `{"cluster_name":"%v","status":"green","number_of_nodes":1}`, clusterName)
+		case "/_nodes/stats":
+			fmt.Fprintf(w, `{"cluster_name":"%v","nodes":{"a":{"name":"%v-node-1"}}}`, clusterName, clusterName)
+		default:
+			fmt.Fprintln(w, `{"version":{"number":"7.10.0"}}`)
+		}
+	}))
+}
+
+func TestCollectorsRunIndependently(t *testing.T) {
+	defer useTemporaryStateDirectory(t)()
+
+	fastServer := newTestClusterServer("fast", 0)
+	defer fastServer.Close()
+
+	slowServer := newTestClusterServer("slow", 300*time.Millisecond)
+	defer slowServer.Close()
+
+	fastCollector := &clusterCollector{
+		Config: elasticHostConfig{Hosts: []string{fastServer.URL}, ClusterName: "fast", ExpectedNodeCount: 1},
+		Health: &clusterHealthMonitor{ClusterName: "fast"},
+	}
+	slowCollector := &clusterCollector{
+		Config: elasticHostConfig{Hosts: []string{slowServer.URL}, ClusterName: "slow", ExpectedNodeCount: 1},
+		Health: &clusterHealthMonitor{ClusterName: "slow"},
+	}
+
+	deadline := time.Now().Add(500 * time.Millisecond)
+	var wg sync.WaitGroup
+	fastCollector.start(deadline, &wg)
+	slowCollector.start(deadline, &wg)
+
+	if slowCollector.start(deadline, &wg) {
+		t.Fail()
+		t.Logf("A collection should not start while the last one for the cluster is running")
+	}
+
+	waitForCollections(&wg, deadline)
+	if time.Now().After(deadline.Add(100 * time.Millisecond)) {
+		t.Fail()
+		t.Logf("Waiting for collections should stop at the deadline")
+	}
+
+	wg.Wait()
+
+	if len(fastCollector.LastCollectionErrors) > 0 {
+		t.Fail()
+		t.Log("Fast collection should not have errors: ", fastCollector.LastCollectionErrors)
+	}
+
+	if len(fastCollector.Nodes.nodeList) != 1 || fastCollector.Nodes.nodeList[0].Name != "fast-node-1" {
+		t.Fail()
+		t.Log("Fast collector should only have its own node: ", fastCollector.Nodes.nodeList)
+	}
+
+	if !fastCollector.Nodes.nodeList[0].Processed {
+		t.Fail()
+		t.Log("Fast collector node should have been processed")
+	}
+
+	if fastCollector.Health.ClusterState != "green" {
+		t.Fail()
+		t.Logf("Fast collector health should be green, was %v", fastCollector.Health.ClusterState)
+	}
+
+	if len(slowCollector.LastCollectionErrors) == 0 {
+		t.Fail()
+		t.Logf("Slow collection should have been stopped at the deadline")
+	}
+}
@@ -1,8 +1,15 @@
 package elastic
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
+	"regexp"
+	"strings"
 
 	"gopkg.in/natefinch/lumberjack.v2"
 	"gopkg.in/yaml.v2"
@@ -11,60 +18,332 @@ import (
 var configuration options
 
 type options struct {
-	CollectInterval            int                 `yaml:"collect_interval"`
-	ElasticClientsFrom         []elasticHostConfig `yaml:"elastic_clients_from"`
-	ElasticClientsTo           []string            `yaml:"elastic_clients_to"`
-	NotifyOnNodeCountChange    bool                `yaml:"notify_on_node_count_change"`
-	NotifyOnClusterYellow      bool                `yaml:"notify_on_cluster_yellow"`
-	NotifyOnClusterRed         bool                `yaml:"notify_on_cluster_red"`
-	NotifyOnClusterUnavailable bool                `yaml:"notify_on_cluster_unavailable"`
-	Notifications              []string            `yaml:"notifications"`
-	IndexPrefix                string              `yaml:"index_prefix"`
-	DefaultSlackWebookURI      string              `yaml:"slack_webhook_uri"`
-	DefaultSlackWebookChannel  string              `yaml:"slack_webhook_channel"`
-	DefaultSlackWebookSender   string              `yaml:"slack_webhook_sender"`
-	DefaultSlackWebookEmoji    string              `yaml:"slack_webhook_emoji"`
-	DefaultSMTPServer          string              `yaml:"smtp_server"`
-	DefaultSMTPPort            int                 `yaml:"smtp_port"`
-	DefaultSMTPAuthUser        string              `yaml:"smtp_auth_user"`
-	DefaultSMTPAuthPassword    string              `yaml:"smtp_auth_password"`
-	DefaultSMTPFromAddress     string              `yaml:"smtp_from_address"`
-	DefaultSMTPToAddresses     []string            `yaml:"smtp_to_addresses"`
-	DefaultHipChatAuthToken    string              `yaml:"hipchat_auth_token"`
-	DefaultHipBaseURL          string              `yaml:"hipchat_base_url"`
-	DefaultHipChatRoom         string              `yaml:"hipchat_room"`
+	CollectInterval            int                  `yaml:"collect_interval"`
+	CollectTimeout             int                  `yaml:"collect_timeout"`
+	ElasticClientsFrom         []elasticHostConfig  `yaml:"elastic_clients_from"`
+	ElasticClientsTo           []string             `yaml:"elastic_clients_to"`
+	ElasticClientsToSecurity   clientSecurityConfig `yaml:"elastic_clients_to_security"`
+	NotifyOnNodeCountChange    bool                 `yaml:"notify_on_node_count_change"`
+	NotifyOnClusterYellow      bool                 `yaml:"notify_on_cluster_yellow"`
+	NotifyOnClusterRed         bool                 `yaml:"notify_on_cluster_red"`
+	NotifyOnClusterUnavailable bool                 `yaml:"notify_on_cluster_unavailable"`
+	NotifyOnResolved           bool                 `yaml:"notify_on_resolved"`
+	Notifications              []string             `yaml:"notifications"`
+	NotificationRouting        map[string][]string  `yaml:"notification_routing"`
+	Silences                   []silence            `yaml:"silences"`
+	SilenceAPIToken            string               `yaml:"silence_api_token"`
+	IndexPrefix                string               `yaml:"index_prefix"`
+	BulkMaxDocs                int                  `yaml:"bulk_max_docs"`
+	BulkMaxBytes               int                  `yaml:"bulk_max_bytes"`
+	BulkFlushInterval          int                  `yaml:"bulk_flush_interval"`
+	SpoolDirectory             string               `yaml:"spool_directory"`
+	SpoolMaxBytes              int64                `yaml:"spool_max_bytes"`
+	SpoolMaxAge                int                  `yaml:"spool_max_age"`
+	StateDirectory             string               `yaml:"state_directory"`
+	MetricsListenAddress       string               `yaml:"metrics_listen_address"`
+	StatusListenAddress        string               `yaml:"status_listen_address"`
+	KibanaURL                  string               `yaml:"kibana_url"`
+	DefaultSlackWebookURI      string               `yaml:"slack_webhook_uri"`
+	DefaultSlackWebookChannel  string               `yaml:"slack_webhook_channel"`
+	DefaultSlackWebookSender   string               `yaml:"slack_webhook_sender"`
+	DefaultSlackWebookEmoji    string               `yaml:"slack_webhook_emoji"`
+	DefaultSMTPServer          string               `yaml:"smtp_server"`
+	DefaultSMTPPort            int                  `yaml:"smtp_port"`
+	DefaultSMTPAuthUser        string               `yaml:"smtp_auth_user"`
+	DefaultSMTPAuthPassword    string               `yaml:"smtp_auth_password"`
+	DefaultSMTPFromAddress     string               `yaml:"smtp_from_address"`
+	DefaultSMTPToAddresses     []string             `yaml:"smtp_to_addresses"`
+	DefaultHipChatAuthToken    string               `yaml:"hipchat_auth_token"`
+	DefaultHipBaseURL          string               `yaml:"hipchat_base_url"`
+	DefaultHipChatRoom         string               `yaml:"hipchat_room"`
+	DefaultPagerDutyRoutingKey string               `yaml:"pagerduty_routing_key"`
+	PagerDutyEventsURI         string               `yaml:"pagerduty_events_uri"`
+	DefaultWebhookURI          string               `yaml:"webhook_uri"`
+	DefaultWebhookMethod       string               `yaml:"webhook_method"`
+	DefaultWebhookHeaders      map[string]string    `yaml:"webhook_headers"`
+	DefaultWebhookBodyTemplate string               `yaml:"webhook_body_template"`
 }
 
 type elasticHostConfig struct {
-	Hosts             []string `yaml:"hosts"`
-	ClusterName       string   `yaml:"cluster_name"`
-	ExpectedNodeCount int      `yaml:"expected_node_count"`
+	Hosts             []string             `yaml:"hosts"`
+	ClusterName       string               `yaml:"cluster_name"`
+	ExpectedNodeCount int                  `yaml:"expected_node_count"`
+	Security          clientSecurityConfig `yaml:",inline"`
+}
+
+// StartupOptions are where gwylio reads its configuration and rules from,
+// and where it writes its log. They are set from flags or environment
+// variables before gwylio starts.
+type StartupOptions struct {
+	ConfigFile   string
+	RulesFolders []string
+
+	// A file to write the log to, "stdout", "stderr" or "none"
+	LogDestination string
+
+	// Log rotation, only used when the log is written to a file
+	LogMaxSize    int // megabytes
+	LogMaxBackups int
+	LogMaxAge     int // days
+}
+
+var startupOptions = DefaultStartupOptions()
+
+// DefaultStartupOptions reads gwylio.yml and the rules folder from the
+// working directory, and writes gwylio.log there
+func DefaultStartupOptions() StartupOptions {
+	return StartupOptions{
+		ConfigFile:     "gwylio.yml",
+		RulesFolders:   []string{"rules"},
+		LogDestination: "gwylio.log",
+		LogMaxSize:     50,
+		LogMaxBackups:  1,
+		LogMaxAge:      28,
+	}
+}
+
+// SetStartupOptions changes where gwylio reads its configuration and rules
+// from, and where it writes its log. It has to be called before starting.
+func SetStartupOptions(options StartupOptions) {
+	startupOptions = options
 }
 
 func loadConfiguration() {
-	log.SetOutput(&lumberjack.Logger{
-		Filename:   "gwylio.log",
-		MaxSize:    50, // megabytes
-		MaxBackups: 1,
-		MaxAge:     28, //days
-	})
+	configureLogging()
 
 	log.Print("Starting up...")
 	log.Print("Loading Config...")
 
-	yamlFile, err := ioutil.ReadFile("gwylio.yml")
+	err := readConfiguration(startupOptions.ConfigFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, hostCollection := range configuration.ElasticClientsFrom {
+		for _, host := range hostCollection.Hosts {
+			log.Print("Configured for Host: ", host)
+		}
+	}
+
+	if errs := validateConfiguration(); len(errs) > 0 {
+		log.Fatal(errs[0])
+	}
+
+	configureHostClients()
+}
+
+func configureLogging() {
+	switch startupOptions.LogDestination {
+	case "none":
+		log.SetOutput(ioutil.Discard)
+	case "stdout":
+		log.SetOutput(os.Stdout)
+	case "stderr":
+		log.SetOutput(os.Stderr)
+	default:
+		log.SetOutput(&lumberjack.Logger{
+			Filename:   startupOptions.LogDestination,
+			MaxSize:    startupOptions.LogMaxSize,
+			MaxBackups: startupOptions.LogMaxBackups,
+			MaxAge:     startupOptions.LogMaxAge,
+		})
+	}
+}
+
+func readConfiguration(path string) error {
+	yamlFile, err := ioutil.ReadFile(path)
 	if err != nil {
-		log.Fatal("yamlFile.Get err ", err)
+		return fmt.Errorf("error reading %v: %v", path, err)
+	}
+
+	yamlFile, err = expandEnvironmentVariables(yamlFile)
+	if err != nil {
+		return fmt.Errorf("error reading %v: %v", path, err)
 	}
 
 	err = yaml.Unmarshal(yamlFile, &configuration)
 	if err != nil {
-		log.Fatal("error: ", err)
+		return fmt.Errorf("error parsing %v: %v", path, err)
 	}
 
-	for _, hostCollection := range configuration.ElasticClientsFrom {
-		for _, host := range hostCollection.Hosts {
-			log.Print("Configured for Host: ", host)
+	return nil
+}
+
+var environmentVariablePattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// Values that can be put in an unquoted YAML value as they are
+var plainValuePattern = regexp.MustCompile(`^[A-Za-z0-9_.+\-/@]*$`)
+
+// Replaces ${NAME} with the value of the environment variable, so secrets
+// don't have to be kept in gwylio.yml. ${NAME:-default} uses the default
+// if the variable isn't set. Any other variable that isn't set is an error.
+// Comments are left alone.
+//
+// Values are escaped for the string they are put in, so a value can't
+// change the structure of the file. A variable that is a whole unquoted
+// value is quoted unless it is a plain word or number.
+func expandEnvironmentVariables(contents []byte) ([]byte, error) {
+	var missing []string
+
+	lines := strings.Split(string(contents), "\n")
+	for i, line := range lines {
+		expanded, err := expandEnvironmentVariablesInLine(line, &missing)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", i+1, err)
+		}
+		lines[i] = expanded
+	}
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("environment variables are not set: %v", strings.Join(missing, ", "))
+	}
+
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+func expandEnvironmentVariablesInLine(line string, missing *[]string) (string, error) {
+	matches := environmentVariablePattern.FindAllStringSubmatchIndex(line, -1)
+	if len(matches) == 0 {
+		return line, nil
+	}
+
+	var expanded bytes.Buffer
+	written := 0
+
+	// The quote the text being scanned is inside, if any
+	var quote byte
+
+	for position := 0; position < len(line); position++ {
+		if len(matches) > 0 && matches[0][0] == position {
+			match := matches[0]
+			matches = matches[1:]
+
+			name := line[match[2]:match[3]]
+			value, ok := os.LookupEnv(name)
+			if !ok && match[4] >= 0 {
+				value, ok = line[match[6]:match[7]], true
+			}
+
+			replacement := line[match[0]:match[1]]
+			if ok {
+				var err error
+				replacement, err = escapeYAMLValue(value, quote,
+					startsYAMLValue(line[:match[0]]) && endsYAMLValue(line[match[1]:]))
+				if err != nil {
+					return "", fmt.Errorf("${%v} %v", name, err)
+				}
+			} else {
+				*missing = append(*missing, name)
+			}
+
+			expanded.WriteString(line[written:match[0]])
+			expanded.WriteString(replacement)
+			written = match[1]
+			position = match[1] - 1
+			continue
+		}
+
+		switch character := line[position]; {
+		case quote == '"':
+			if character == '\\' {
+				position++
+			} else if character == '"' {
+				quote = 0
+			}
+
+		case quote == '\'':
+			// Two single quotes are a quote inside the string
+			if character == '\'' {
+				if position+1 < len(line) && line[position+1] == '\'' {
+					position++
+				} else {
+					quote = 0
+				}
+			}
+
+		case character == '#' && (position == 0 || line[position-1] == ' ' || line[position-1] == '\t'):
+			// The rest of the line is a comment
+			expanded.WriteString(line[written:])
+			return expanded.String(), nil
+
+		case (character == '"' || character == '\'') && startsYAMLValue(line[:position]):
+			quote = character
+		}
+	}
+
+	expanded.WriteString(line[written:])
+	return expanded.String(), nil
+}
+
+// Returns true if a value starting after before would be a new value, rather
+// than part of one
+func startsYAMLValue(before string) bool {
+	trimmed := strings.TrimRight(before, " \t")
+	if trimmed == "" || strings.ContainsAny(trimmed[len(trimmed)-1:], "[{,") {
+		return true
+	}
+
+	// A key's colon and a list item's dash are followed by a space
+	return strings.ContainsAny(trimmed[len(trimmed)-1:], ":-") && len(trimmed) < len(before)
+}
+
+// Returns true if a value ending before after would be the end of it
+func endsYAMLValue(after string) bool {
+	rest := strings.TrimLeft(after, " \t")
+	if rest == "" || strings.ContainsAny(rest[:1], ",]}") {
+		return true
+	}
+	return rest[0] == '#' && len(rest) < len(after)
+}
+
+// Escapes a value for the string it is put in, given the quote the string
+// uses. wholeValue is true if the variable is the whole of an unquoted value.
+func escapeYAMLValue(value string, quote byte, wholeValue bool) (string, error) {
+	switch quote {
+	case '"':
+		// JSON escapes are valid in YAML double quoted strings
+		quoted, err := json.Marshal(value)
+		if err != nil {
+			return "", err
 		}
+		return string(quoted[1 : len(quoted)-1]), nil
+
+	case '\'':
+		if strings.ContainsAny(value, "\r\n") {
+			return "", errors.New("has a line break so can't be used in a single quoted string, use double quotes")
+		}
+		return strings.Replace(value, "'", "''", -1), nil
+	}
+
+	if plainValuePattern.MatchString(value) {
+		return value, nil
+	}
+
+	if wholeValue {
+		quoted, err := json.Marshal(value)
+		return string(quoted), err
 	}
+
+	return "", errors.New("has characters that can't be used in an unquoted value, quote the value")
+}
+
+// Returns everything wrong with the configuration, rather than stopping at
+// the first problem
+func validateConfiguration() []error {
+	var errs []error
+
+	for i, cluster := range configuration.ElasticClientsFrom {
+		if cluster.ClusterName == "" {
+			errs = append(errs, fmt.Errorf("elastic_clients_from entry %v has no cluster_name", i+1))
+		}
+		if len(cluster.Hosts) == 0 {
+			errs = append(errs, fmt.Errorf("elastic_clients_from entry %v has no hosts", i+1))
+		}
+	}
+
+	if err := validateNotificationRouting(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return append(errs, validateConfiguredSilences()...)
 }
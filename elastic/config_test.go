@@ -0,0 +1,108 @@
+package elastic
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestExpandEnvironmentVariables(t *testing.T) {
+	os.Setenv("GWYLIO_TEST_PASSWORD", "s3cret")
+	os.Unsetenv("GWYLIO_TEST_PORT")
+	defer os.Unsetenv("GWYLIO_TEST_PASSWORD")
+
+	expanded, err := expandEnvironmentVariables([]byte(`smtp_auth_password: "${GWYLIO_TEST_PASSWORD}"
+smtp_port: ${GWYLIO_TEST_PORT:-25}
+# webhook_uri: "${GWYLIO_TEST_WEBHOOK}"
+webhook_body_template: '{"cost": "$5"}'`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `smtp_auth_password: "s3cret"
+smtp_port: 25
+# webhook_uri: "${GWYLIO_TEST_WEBHOOK}"
+webhook_body_template: '{"cost": "$5"}'`
+	if string(expanded) != expected {
+		t.Fail()
+		t.Logf("Variables should be replaced and defaults used, except in comments, was:\n%v", string(expanded))
+	}
+}
+
+func TestExpandEnvironmentVariablesEscapesValues(t *testing.T) {
+	password := "abc: def #x \"quoted\" 'single'"
+	os.Setenv("GWYLIO_TEST_PASSWORD", password)
+	os.Setenv("GWYLIO_TEST_USER", "ops\nsmtp_server: evil.example.com")
+	defer os.Unsetenv("GWYLIO_TEST_PASSWORD")
+	defer os.Unsetenv("GWYLIO_TEST_USER")
+
+	expanded, err := expandEnvironmentVariables([]byte(`smtp_auth_password: ${GWYLIO_TEST_PASSWORD}
+smtp_auth_user: "${GWYLIO_TEST_USER}"
+hipchat_auth_token: '${GWYLIO_TEST_PASSWORD}'
+smtp_to_addresses: [${GWYLIO_TEST_PASSWORD}, "b-${GWYLIO_TEST_PASSWORD}"] # ${GWYLIO_TEST_MISSING}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var config options
+	err = yaml.Unmarshal(expanded, &config)
+	if err != nil {
+		t.Fatalf("Expanded configuration should parse, was %v:\n%v", err, string(expanded))
+	}
+
+	if config.DefaultSMTPAuthPassword != password || config.DefaultHipChatAuthToken != password {
+		t.Fail()
+		t.Logf("Values with : and # should be kept as they are, was %q and %q",
+			config.DefaultSMTPAuthPassword, config.DefaultHipChatAuthToken)
+	}
+
+	if config.DefaultSMTPAuthUser != "ops\nsmtp_server: evil.example.com" || config.DefaultSMTPServer != "" {
+		t.Fail()
+		t.Logf("A value with a line break should not add settings, was %q", config.DefaultSMTPServer)
+	}
+
+	if len(config.DefaultSMTPToAddresses) != 2 || config.DefaultSMTPToAddresses[1] != "b-"+password {
+		t.Fail()
+		t.Logf("Values in lists should be escaped, was %q", config.DefaultSMTPToAddresses)
+	}
+
+	_, err = expandEnvironmentVariables([]byte(`smtp_server: mail-${GWYLIO_TEST_PASSWORD}`))
+	if err == nil {
+		t.Fail()
+		t.Logf("A value that can't be put in part of an unquoted value should be an error")
+	}
+}
+
+func TestExpandMissingEnvironmentVariables(t *testing.T) {
+	os.Unsetenv("GWYLIO_TEST_MISSING")
+
+	_, err := expandEnvironmentVariables([]byte(`webhook_uri: "${GWYLIO_TEST_MISSING}"`))
+	if err == nil || !strings.Contains(err.Error(), "GWYLIO_TEST_MISSING") {
+		t.Fail()
+		t.Logf("A variable that isn't set should be an error naming it, was %v", err)
+	}
+}
+
+func TestRulesFromEveryFolder(t *testing.T) {
+	inConfigurationFolder(t, "", map[string]string{"errors.json": testCountRule}, func() {
+		os.Mkdir("more-rules", 0755)
+		os.Mkdir("empty-rules", 0755)
+		f, _ := os.Create("more-rules/latency.json")
+		f.Close()
+
+		SetStartupOptions(StartupOptions{RulesFolders: []string{"rules", "more-rules", "empty-rules", "missing"}})
+		defer SetStartupOptions(DefaultStartupOptions())
+
+		paths, err := ruleFiles()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.Join(paths, ",") != "rules/errors.json,more-rules/latency.json" {
+			t.Fail()
+			t.Logf("Rule files should be read from every folder, was %v", paths)
+		}
+	})
+}
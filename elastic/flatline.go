@@ -0,0 +1,91 @@
+package elastic
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Tracks how long a flatline rule has been under its threshold. Returns true
+// once it has been under it for the rule's flatline_duration.
+func (rule *notificationRule) checkFlatline(below bool, now time.Time) bool {
+	if !below {
+		rule.BelowThresholdSince = time.Time{}
+		return false
+	}
+
+	if rule.BelowThresholdSince.IsZero() {
+		rule.BelowThresholdSince = now
+	}
+
+	return now.Sub(rule.BelowThresholdSince) >= time.Minute*time.Duration(rule.FlatlineDuration)
+}
+
+func flatlineDescription(rule *notificationRule, result ruleResult, now time.Time) string {
+	if rule.BelowThresholdSince.IsZero() {
+		return result.Description
+	}
+
+	return fmt.Sprintf("%v, under %v for %v", result.Description, rule.Threshold,
+		formatIncidentDuration(now.Sub(rule.BelowThresholdSince)))
+}
+
+// Counts failed runs of a rule's query. Once query_error_threshold runs in a
+// row have failed, a notification is sent so a broken rule isn't missed.
+func recordQueryError(rule *notificationRule, err error) {
+	rule.ConsecutiveQueryErrors++
+	rule.LastQueryError = err.Error()
+
+	recordAlertHistory(ruleEvaluationHistory(rule, ruleResult{Description: err.Error()}, historyStatusError))
+
+	if rule.QueryErrorThreshold <= 0 || rule.ConsecutiveQueryErrors < rule.QueryErrorThreshold {
+		return
+	}
+
+	if !rule.QueryErrorAlert.fire(time.Now()) {
+		return
+	}
+
+	sendNotification(alertNotification{
+		Key:         ruleQueryErrorAlertKey(rule.Name),
+		Status:      alertStateFiring,
+		ClusterName: rule.ClusterName,
+		RuleName:    rule.Name,
+		Message: fmt.Sprintf("Query for rule %v has failed %v times in a row: %v",
+			rule.Name, rule.ConsecutiveQueryErrors, err),
+		Severity:    severityWarning,
+		Value:       float64(rule.ConsecutiveQueryErrors),
+		Threshold:   float64(rule.QueryErrorThreshold),
+		Operator:    ">=",
+		Timestamp:   time.Now(),
+		FiringSince: rule.QueryErrorAlert.FiringSince,
+		Overrides:   rule.NotificationOverrides,
+	})
+}
+
+// Resets the failed run count and resolves the query error alert
+func recordQuerySuccess(rule *notificationRule) {
+	if rule.ConsecutiveQueryErrors > 0 {
+		log.Printf("Query for rule %v succeeded after %v failures", rule.Name, rule.ConsecutiveQueryErrors)
+	}
+
+	rule.ConsecutiveQueryErrors = 0
+	rule.LastQueryError = ""
+
+	if duration, resolved := rule.QueryErrorAlert.resolve(time.Now()); resolved {
+		sendNotification(alertNotification{
+			Key:         ruleQueryErrorAlertKey(rule.Name),
+			Status:      alertStateResolved,
+			ClusterName: rule.ClusterName,
+			RuleName:    rule.Name,
+			Message: fmt.Sprintf("Resolved: Query for rule %v is working again after %v",
+				rule.Name, formatIncidentDuration(duration)),
+			Severity:    severityWarning,
+			Threshold:   float64(rule.QueryErrorThreshold),
+			Operator:    ">=",
+			Timestamp:   time.Now(),
+			FiringSince: rule.QueryErrorAlert.FiringSince,
+			Overrides:   rule.NotificationOverrides,
+		})
+	}
+}
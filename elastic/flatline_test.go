@@ -0,0 +1,79 @@
+package elastic
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCheckFlatline(t *testing.T) {
+	rule := notificationRule{FlatlineDuration: 15}
+	start := time.Now()
+
+	if rule.checkFlatline(true, start) {
+		t.Fail()
+		t.Logf("Flatline should not fire before flatline_duration has passed")
+	}
+
+	if !rule.checkFlatline(true, start.Add(time.Minute*15)) {
+		t.Fail()
+		t.Logf("Flatline should fire once it has been under the threshold for flatline_duration")
+	}
+
+	if rule.checkFlatline(false, start.Add(time.Minute*16)) {
+		t.Fail()
+		t.Logf("Flatline should not fire once the count is back over the threshold")
+	}
+
+	if !rule.BelowThresholdSince.IsZero() {
+		t.Fail()
+		t.Logf("Time under the threshold should be reset, was %v", rule.BelowThresholdSince)
+	}
+
+	if rule.checkFlatline(true, start.Add(time.Minute*17)) {
+		t.Fail()
+		t.Logf("Flatline should start timing again after being reset")
+	}
+}
+
+func TestQueryErrorAlert(t *testing.T) {
+	configuration.Notifications = nil
+	rule := notificationRule{Name: "Broken Rule", QueryErrorThreshold: 3}
+
+	for i := 0; i < 2; i++ {
+		recordQueryError(&rule, errors.New("index_not_found_exception"))
+	}
+
+	if rule.QueryErrorAlert.isFiring() {
+		t.Fail()
+		t.Logf("Query error alert should not fire before query_error_threshold failures")
+	}
+
+	recordQueryError(&rule, errors.New("index_not_found_exception"))
+
+	if !rule.QueryErrorAlert.isFiring() {
+		t.Fail()
+		t.Logf("Query error alert should fire after %v failures, had %v", rule.QueryErrorThreshold, rule.ConsecutiveQueryErrors)
+	}
+
+	recordQuerySuccess(&rule)
+
+	if rule.ConsecutiveQueryErrors != 0 || rule.QueryErrorAlert.State != alertStateResolved {
+		t.Fail()
+		t.Logf("A successful query should reset the count and resolve the alert, was %v %v",
+			rule.ConsecutiveQueryErrors, rule.QueryErrorAlert.State)
+	}
+}
+
+func TestQueryErrorAlertDisabled(t *testing.T) {
+	rule := notificationRule{Name: "Broken Rule"}
+
+	for i := 0; i < 10; i++ {
+		recordQueryError(&rule, errors.New("timeout"))
+	}
+
+	if rule.QueryErrorAlert.isFiring() {
+		t.Fail()
+		t.Logf("Query error alert should not fire when query_error_threshold isn't set")
+	}
+}
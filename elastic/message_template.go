@@ -0,0 +1,229 @@
+package elastic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Formats a notification message can be rendered in
+const (
+	messageFormatPlain = "plain"
+	messageFormatSlack = "slack"
+)
+
+// Number of search hits or query_key values a message template can use
+// when notification_hits isn't set
+const defaultNotificationHits = 5
+
+// A notification_message that is a template, with the data to render it.
+// The rendered template is put into Wrap, so a resolved notification can
+// add to it.
+type notificationTemplate struct {
+	Text string
+	Wrap string
+	Data notificationTemplateData
+}
+
+// The data available to a notification_message template
+type notificationTemplateData struct {
+	RuleName      string
+	ClusterName   string
+	Status        string
+	Severity      string
+	Value         float64
+	Threshold     float64
+	Operator      string
+	Time          time.Time
+	KibanaURL     string
+	QueryKey      string
+	QueryKeyValue string
+	Description   string
+	Hits          []map[string]interface{}
+	Buckets       []notificationBucket
+}
+
+// One query_key value and its result
+type notificationBucket struct {
+	Key   string
+	Value float64
+}
+
+// Only messages with an action are templates, so existing messages keep
+// having the result appended to them
+func isMessageTemplate(message string) bool {
+	return strings.Contains(message, "{{")
+}
+
+// Functions for formatting text in a message template. Each notifier gets
+// them in its own format.
+func messageTemplateFunctions(format string) template.FuncMap {
+	return template.FuncMap{
+		"bold": func(text interface{}) string {
+			if format == messageFormatSlack {
+				return fmt.Sprintf("*%v*", text)
+			}
+			return fmt.Sprint(text)
+		},
+		"code": func(text interface{}) string {
+			if format == messageFormatSlack {
+				return fmt.Sprintf("`%v`", text)
+			}
+			return fmt.Sprint(text)
+		},
+		"link": func(url string, text string) string {
+			if format == messageFormatSlack {
+				return fmt.Sprintf("<%v|%v>", url, text)
+			}
+			return fmt.Sprintf("%v (%v)", text, url)
+		},
+		"truncate": func(length int, text interface{}) string {
+			value := []rune(fmt.Sprint(text))
+			if len(value) <= length {
+				return string(value)
+			}
+			return string(value[:length]) + "..."
+		},
+		"json": func(value interface{}) (string, error) {
+			valueBytes, err := json.Marshal(value)
+			return string(valueBytes), err
+		},
+	}
+}
+
+// Checks a rule's notification_message template when the rule is loaded
+func parseMessageTemplate(text string) error {
+	_, err := template.New("notification_message").Funcs(messageTemplateFunctions(messageFormatPlain)).Parse(text)
+	return err
+}
+
+func renderMessageTemplate(text string, data notificationTemplateData, format string) (string, error) {
+	parsedTemplate, err := template.New("notification_message").Funcs(messageTemplateFunctions(format)).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var message bytes.Buffer
+	err = parsedTemplate.Execute(&message, data)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(message.String()), nil
+}
+
+// Returns the alert's message in the notifier's format. Messages that
+// aren't templates are the same in every format.
+func (alert alertNotification) messageFor(format string) string {
+	if alert.Template == nil {
+		return alert.Message
+	}
+
+	rendered, err := renderMessageTemplate(alert.Template.Text, alert.Template.Data, format)
+	if err != nil {
+		log.Printf("Error rendering notification message for rule %v : %v", alert.RuleName, err)
+		return alert.Message
+	}
+
+	return fmt.Sprintf(alert.Template.Wrap, rendered)
+}
+
+// Builds the message for a rule notification. If the rule's message is a
+// template it is rendered as plain text and returned as well, so notifiers
+// can render it in their own format. Otherwise message is used as it is.
+func buildRuleMessage(rule *notificationRule, result ruleResult, status string, message string,
+	templateWrap string) (string, *notificationTemplate) {
+
+	if !isMessageTemplate(rule.NotificationMessage) {
+		return message, nil
+	}
+
+	messageTemplate := &notificationTemplate{
+		Text: rule.NotificationMessage,
+		Wrap: templateWrap,
+		Data: buildTemplateData(rule, result, status),
+	}
+
+	alert := alertNotification{RuleName: rule.Name, Message: message, Template: messageTemplate}
+	return alert.messageFor(messageFormatPlain), messageTemplate
+}
+
+func buildTemplateData(rule *notificationRule, result ruleResult, status string) notificationTemplateData {
+	hitLimit := rule.NotificationHits
+	if hitLimit <= 0 {
+		hitLimit = defaultNotificationHits
+	}
+
+	data := notificationTemplateData{
+		RuleName:      rule.Name,
+		ClusterName:   rule.ClusterName,
+		Status:        status,
+		Severity:      rule.Severity,
+		Value:         result.Value,
+		Threshold:     rule.Threshold,
+		Operator:      rule.Operator,
+		Time:          time.Now(),
+		KibanaURL:     ruleKibanaURL(rule),
+		QueryKey:      rule.QueryKey,
+		QueryKeyValue: result.QueryKeyValue,
+		Description:   result.Description,
+		Hits:          parseTemplateHits(result.Attachment, hitLimit),
+	}
+
+	for i, bucket := range result.Buckets {
+		if i >= hitLimit {
+			break
+		}
+		data.Buckets = append(data.Buckets, bucket)
+	}
+
+	return data
+}
+
+// The rule's kibana_url, or the one from gwylio.yml if it doesn't have one
+func ruleKibanaURL(rule *notificationRule) string {
+	if rule.KibanaURL != "" {
+		return rule.KibanaURL
+	}
+	return configuration.KibanaURL
+}
+
+type templateHit struct {
+	ID     string                 `json:"_id"`
+	Index  string                 `json:"_index"`
+	Source map[string]interface{} `json:"_source"`
+}
+
+// Returns the source of the first hits, with their _id and _index added
+func parseTemplateHits(attachment []byte, limit int) []map[string]interface{} {
+	if len(attachment) == 0 {
+		return nil
+	}
+
+	var hits []templateHit
+	err := json.Unmarshal(attachment, &hits)
+	if err != nil {
+		return nil
+	}
+
+	var sources []map[string]interface{}
+	for i, hit := range hits {
+		if i >= limit {
+			break
+		}
+
+		source := hit.Source
+		if source == nil {
+			source = map[string]interface{}{}
+		}
+		source["_id"] = hit.ID
+		source["_index"] = hit.Index
+		sources = append(sources, source)
+	}
+
+	return sources
+}
@@ -0,0 +1,83 @@
+package elastic
+
+import (
+	"testing"
+)
+
+func TestBuildRuleMessageWithoutTemplate(t *testing.T) {
+	rule := notificationRule{NotificationMessage: "Example Rule was hit"}
+
+	message, messageTemplate := buildRuleMessage(&rule, countResult(12, nil), alertStateFiring,
+		"Example Rule was hit Result count was 12", "%v")
+
+	if messageTemplate != nil {
+		t.Fail()
+		t.Logf("A message without actions should not be treated as a template")
+	}
+
+	if message != "Example Rule was hit Result count was 12" {
+		t.Fail()
+		t.Logf("Message should be used as it is, was %v", message)
+	}
+}
+
+func TestBuildRuleMessageFormats(t *testing.T) {
+	configuration.KibanaURL = "https://kibana.example.com/app/discover"
+	defer func() { configuration.KibanaURL = "" }()
+
+	rule := notificationRule{
+		Name:                "Server errors",
+		NotificationMessage: `{{bold .RuleName}}: {{.Value}} errors on {{(index .Hits 0).host}} {{link .KibanaURL "Open in Kibana"}}`,
+	}
+
+	hits := []byte(`[{"_id":"1","_index":"logstash-2016.08.04","_source":{"host":"web-1","message":"timeout"}}]`)
+	result := countResult(12, hits)
+
+	message, messageTemplate := buildRuleMessage(&rule, result, alertStateFiring, "", "%v")
+
+	expected := "Server errors: 12 errors on web-1 Open in Kibana (https://kibana.example.com/app/discover)"
+	if message != expected {
+		t.Fail()
+		t.Logf("Plain message is incorrect. Should be %v, was %v", expected, message)
+	}
+
+	alert := alertNotification{Message: message, Template: messageTemplate}
+	expected = "*Server errors*: 12 errors on web-1 <https://kibana.example.com/app/discover|Open in Kibana>"
+	if alert.messageFor(messageFormatSlack) != expected {
+		t.Fail()
+		t.Logf("Slack message is incorrect. Should be %v, was %v", expected, alert.messageFor(messageFormatSlack))
+	}
+}
+
+func TestBuildRuleMessageResolved(t *testing.T) {
+	rule := notificationRule{NotificationMessage: `{{.QueryKey}} {{.QueryKeyValue}} is {{.Status}}`, QueryKey: "host"}
+	result := ruleResult{QueryKeyValue: "web-1"}
+
+	message, _ := buildRuleMessage(&rule, result, alertStateResolved, "", "Resolved: %v after 5m0s")
+
+	if message != "Resolved: host web-1 is resolved after 5m0s" {
+		t.Fail()
+		t.Logf("Resolved message is incorrect, was %v", message)
+	}
+}
+
+func TestParseTemplateHitsLimit(t *testing.T) {
+	hits := []byte(`[{"_id":"1","_source":{"host":"web-1"}},{"_id":"2","_source":{"host":"web-2"}}]`)
+
+	sources := parseTemplateHits(hits, 1)
+	if len(sources) != 1 {
+		t.Fatalf("Only the first hit should be returned, had %v", len(sources))
+	}
+
+	if sources[0]["host"] != "web-1" || sources[0]["_id"] != "1" {
+		t.Fail()
+		t.Logf("Hit source is incorrect, was %v", sources[0])
+	}
+}
+
+func TestParseMessageTemplateErrors(t *testing.T) {
+	if parseMessageTemplate("{{.RuleName") == nil {
+		t.Fail()
+		t.Logf("An unclosed action should not parse")
+	}
+}
@@ -0,0 +1,318 @@
+package elastic
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Cluster and node stats that haven't been updated in this many collect
+// intervals are left out of /metrics, so nodes that leave the cluster and
+// clusters that can't be reached drop off
+const metricsStaleIntervals = 5
+
+type nodeJVMMetrics struct {
+	Memory           nodeJVMMemoryMetrics `json:"mem"`
+	GarbageCollector nodeGCMetrics        `json:"gc"`
+}
+
+type nodeJVMMemoryMetrics struct {
+	HeapUsedInBytes float64 `json:"heap_used_in_bytes"`
+	HeapMaxInBytes  float64 `json:"heap_max_in_bytes"`
+}
+
+type nodeGCMetrics struct {
+	Collectors map[string]nodeGCCollectorMetrics `json:"collectors"`
+}
+
+type nodeGCCollectorMetrics struct {
+	CollectionCount        float64 `json:"collection_count"`
+	CollectionTimeInMillis float64 `json:"collection_time_in_millis"`
+}
+
+type nodeThreadPoolMetrics struct {
+	Rejected float64 `json:"rejected"`
+}
+
+type nodeFileSystemMetrics struct {
+	Total nodeFileSystemTotalMetrics `json:"total"`
+}
+
+type nodeFileSystemTotalMetrics struct {
+	TotalInBytes     float64 `json:"total_in_bytes"`
+	FreeInBytes      float64 `json:"free_in_bytes"`
+	AvailableInBytes float64 `json:"available_in_bytes"`
+}
+
+type nodeIndicesMetrics struct {
+	Docs nodeDocsMetrics `json:"docs"`
+}
+
+type nodeDocsMetrics struct {
+	Count float64 `json:"count"`
+}
+
+type nodeMetrics struct {
+	ClusterName string
+	NodeName    string
+	LastUpdated time.Time
+	JVM         nodeJVMMetrics
+	ThreadPools map[string]nodeThreadPoolMetrics
+	FileSystem  nodeFileSystemMetrics
+	Indices     nodeIndicesMetrics
+}
+
+type clusterHealthMetrics struct {
+	Health      clusterHealth
+	LastUpdated time.Time
+}
+
+type clusterMetric struct {
+	Name  string
+	Help  string
+	Value func(clusterHealth) float64
+}
+
+var metricsLock sync.RWMutex
+var clusterHealthStatMetrics = map[string]clusterHealthMetrics{}
+var nodeStatMetrics = map[string]nodeMetrics{}
+
+var clusterMetrics = []clusterMetric{
+	{"gwylio_cluster_status", "Cluster status (0 = green, 1 = yellow, 2 = red)", clusterStatusValue},
+	{"gwylio_cluster_timed_out", "1 if the cluster health request timed out", func(c clusterHealth) float64 { return boolValue(c.TimedOut) }},
+	{"gwylio_cluster_number_of_nodes", "Number of nodes in the cluster", func(c clusterHealth) float64 { return float64(c.NumberOfNodes) }},
+	{"gwylio_cluster_number_of_data_nodes", "Number of data nodes in the cluster", func(c clusterHealth) float64 { return float64(c.NumberOfDataNodes) }},
+	{"gwylio_cluster_active_primary_shards", "Number of active primary shards", func(c clusterHealth) float64 { return float64(c.ActivePrimaryShards) }},
+	{"gwylio_cluster_active_shards", "Number of active shards", func(c clusterHealth) float64 { return float64(c.ActiveShards) }},
+	{"gwylio_cluster_relocating_shards", "Number of relocating shards", func(c clusterHealth) float64 { return float64(c.RelocatingShards) }},
+	{"gwylio_cluster_initializing_shards", "Number of initializing shards", func(c clusterHealth) float64 { return float64(c.InitializingShards) }},
+	{"gwylio_cluster_unassigned_shards", "Number of unassigned shards", func(c clusterHealth) float64 { return float64(c.UnassignedShards) }},
+	{"gwylio_cluster_delayed_unassigned_shards", "Number of delayed unassigned shards", func(c clusterHealth) float64 { return float64(c.DelayedUnassignedShards) }},
+	{"gwylio_cluster_number_of_pending_tasks", "Number of pending cluster tasks", func(c clusterHealth) float64 { return float64(c.NumberOfPendingTasks) }},
+	{"gwylio_cluster_number_of_in_flight_fetch", "Number of in flight shard fetches", func(c clusterHealth) float64 { return float64(c.NumberOfInFlightFetch) }},
+	{"gwylio_cluster_task_max_waiting_in_queue_seconds", "Longest time a pending task has been waiting", func(c clusterHealth) float64 { return float64(c.TaskMaxWaitingInQueueMillis) / 1000 }},
+	{"gwylio_cluster_active_shards_percent", "Percentage of shards that are active", func(c clusterHealth) float64 { return float64(c.ActiveShardsPercentAsNumber) }},
+}
+
+func clusterStatusValue(cluster clusterHealth) float64 {
+	switch cluster.Status {
+	case "green":
+		return 0
+	case "yellow":
+		return 1
+	}
+	return 2
+}
+
+func boolValue(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// Keeps the latest cluster health for /metrics
+func recordClusterHealthMetrics(cluster clusterHealth) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	clusterHealthStatMetrics[cluster.ClusterName] = clusterHealthMetrics{Health: cluster, LastUpdated: time.Now()}
+}
+
+// Keeps the latest stats for a node for /metrics
+func recordNodeMetrics(clusterName string, node elasticNodeStat) {
+	metrics := nodeMetrics{ClusterName: clusterName, NodeName: node.Name, LastUpdated: time.Now()}
+
+	json.Unmarshal(node.JVMStats, &metrics.JVM)
+	json.Unmarshal(node.ThreadStats, &metrics.ThreadPools)
+	json.Unmarshal(node.FileSystem, &metrics.FileSystem)
+	json.Unmarshal(node.Indices, &metrics.Indices)
+
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	nodeStatMetrics[clusterName+"/"+node.Name] = metrics
+}
+
+func registerMetricsHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+}
+
+// Writes every metric in the Prometheus text exposition format
+func writeMetrics(w io.Writer) {
+	metricsLock.RLock()
+	defer metricsLock.RUnlock()
+
+	clusters := currentClusterHealthMetrics()
+
+	for _, metric := range clusterMetrics {
+		writeMetricHeader(w, metric.Name, metric.Help, "gauge")
+		for _, cluster := range clusters {
+			writeMetric(w, metric.Name, metric.Value(cluster), "cluster", cluster.ClusterName)
+		}
+	}
+
+	nodes := currentNodeMetrics()
+
+	writeMetricHeader(w, "gwylio_node_jvm_heap_used_bytes", "JVM heap in use", "gauge")
+	for _, node := range nodes {
+		writeMetric(w, "gwylio_node_jvm_heap_used_bytes", node.JVM.Memory.HeapUsedInBytes,
+			"cluster", node.ClusterName, "node", node.NodeName)
+	}
+
+	writeMetricHeader(w, "gwylio_node_jvm_heap_max_bytes", "JVM heap available", "gauge")
+	for _, node := range nodes {
+		writeMetric(w, "gwylio_node_jvm_heap_max_bytes", node.JVM.Memory.HeapMaxInBytes,
+			"cluster", node.ClusterName, "node", node.NodeName)
+	}
+
+	writeMetricHeader(w, "gwylio_node_jvm_gc_collections_total", "JVM garbage collections", "counter")
+	for _, node := range nodes {
+		for _, collector := range sortedKeys(node.JVM.GarbageCollector.Collectors) {
+			writeMetric(w, "gwylio_node_jvm_gc_collections_total",
+				node.JVM.GarbageCollector.Collectors[collector].CollectionCount,
+				"cluster", node.ClusterName, "node", node.NodeName, "collector", collector)
+		}
+	}
+
+	writeMetricHeader(w, "gwylio_node_jvm_gc_collection_seconds_total", "Time spent in JVM garbage collection", "counter")
+	for _, node := range nodes {
+		for _, collector := range sortedKeys(node.JVM.GarbageCollector.Collectors) {
+			writeMetric(w, "gwylio_node_jvm_gc_collection_seconds_total",
+				node.JVM.GarbageCollector.Collectors[collector].CollectionTimeInMillis/1000,
+				"cluster", node.ClusterName, "node", node.NodeName, "collector", collector)
+		}
+	}
+
+	writeMetricHeader(w, "gwylio_node_thread_pool_rejected_total", "Thread pool rejections", "counter")
+	for _, node := range nodes {
+		var pools []string
+		for pool := range node.ThreadPools {
+			pools = append(pools, pool)
+		}
+		sort.Strings(pools)
+
+		for _, pool := range pools {
+			writeMetric(w, "gwylio_node_thread_pool_rejected_total", node.ThreadPools[pool].Rejected,
+				"cluster", node.ClusterName, "node", node.NodeName, "pool", pool)
+		}
+	}
+
+	writeMetricHeader(w, "gwylio_node_fs_total_bytes", "Total disk space", "gauge")
+	for _, node := range nodes {
+		writeMetric(w, "gwylio_node_fs_total_bytes", node.FileSystem.Total.TotalInBytes,
+			"cluster", node.ClusterName, "node", node.NodeName)
+	}
+
+	writeMetricHeader(w, "gwylio_node_fs_free_bytes", "Free disk space", "gauge")
+	for _, node := range nodes {
+		writeMetric(w, "gwylio_node_fs_free_bytes", node.FileSystem.Total.FreeInBytes,
+			"cluster", node.ClusterName, "node", node.NodeName)
+	}
+
+	writeMetricHeader(w, "gwylio_node_fs_available_bytes", "Disk space available to Elasticsearch", "gauge")
+	for _, node := range nodes {
+		writeMetric(w, "gwylio_node_fs_available_bytes", node.FileSystem.Total.AvailableInBytes,
+			"cluster", node.ClusterName, "node", node.NodeName)
+	}
+
+	writeMetricHeader(w, "gwylio_node_indices_docs", "Documents on the node", "gauge")
+	for _, node := range nodes {
+		writeMetric(w, "gwylio_node_indices_docs", node.Indices.Docs.Count,
+			"cluster", node.ClusterName, "node", node.NodeName)
+	}
+
+	writeMetricHeader(w, "gwylio_index_queue_spooled_total", "Documents written to the spool", "counter")
+	writeMetric(w, "gwylio_index_queue_spooled_total", float64(atomic.LoadUint64(&indexQueueStats.Spooled)))
+
+	writeMetricHeader(w, "gwylio_index_queue_replayed_total", "Documents replayed from the spool", "counter")
+	writeMetric(w, "gwylio_index_queue_replayed_total", float64(atomic.LoadUint64(&indexQueueStats.Replayed)))
+
+	writeMetricHeader(w, "gwylio_index_queue_dropped_total", "Documents that were dropped", "counter")
+	writeMetric(w, "gwylio_index_queue_dropped_total", float64(atomic.LoadUint64(&indexQueueStats.Dropped)))
+}
+
+// Returns the cluster health that is still current, sorted by cluster name
+func currentClusterHealthMetrics() []clusterHealth {
+	staleAfter := metricsStaleAfter()
+
+	var clusterNames []string
+	for clusterName, cluster := range clusterHealthStatMetrics {
+		if staleAfter == 0 || cluster.LastUpdated.After(time.Now().Add(staleAfter*-1)) {
+			clusterNames = append(clusterNames, clusterName)
+		}
+	}
+	sort.Strings(clusterNames)
+
+	var clusters []clusterHealth
+	for _, clusterName := range clusterNames {
+		clusters = append(clusters, clusterHealthStatMetrics[clusterName].Health)
+	}
+	return clusters
+}
+
+// Returns the node metrics that are still current, sorted by cluster and node name
+func currentNodeMetrics() []nodeMetrics {
+	staleAfter := metricsStaleAfter()
+
+	var keys []string
+	for key, node := range nodeStatMetrics {
+		if staleAfter == 0 || node.LastUpdated.After(time.Now().Add(staleAfter*-1)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var nodes []nodeMetrics
+	for _, key := range keys {
+		nodes = append(nodes, nodeStatMetrics[key])
+	}
+	return nodes
+}
+
+func metricsStaleAfter() time.Duration {
+	return time.Second * time.Duration(configuration.CollectInterval*metricsStaleIntervals)
+}
+
+func sortedKeys(collectors map[string]nodeGCCollectorMetrics) []string {
+	var keys []string
+	for key := range collectors {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeMetricHeader(w io.Writer, name string, help string, metricType string) {
+	fmt.Fprintf(w, "# HELP %v %v\n", name, help)
+	fmt.Fprintf(w, "# TYPE %v %v\n", name, metricType)
+}
+
+// Writes a single sample. labels are passed as name, value pairs.
+func writeMetric(w io.Writer, name string, value float64, labels ...string) {
+	var labelPairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		labelPairs = append(labelPairs, fmt.Sprintf("%v=\"%v\"", labels[i], escapeLabelValue(labels[i+1])))
+	}
+
+	if len(labelPairs) > 0 {
+		fmt.Fprintf(w, "%v{%v} %v\n", name, strings.Join(labelPairs, ","), value)
+	} else {
+		fmt.Fprintf(w, "%v %v\n", name, value)
+	}
+}
+
+func escapeLabelValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return strings.Replace(value, "\n", `\n`, -1)
+}
@@ -0,0 +1,93 @@
+package elastic
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetricsClusterHealth(t *testing.T) {
+	recordClusterHealthMetrics(clusterHealth{ClusterName: "metrics-cluster", Status: "yellow", NumberOfNodes: 3})
+
+	var output bytes.Buffer
+	writeMetrics(&output)
+
+	expectedLines := []string{
+		"# TYPE gwylio_cluster_status gauge",
+		`gwylio_cluster_status{cluster="metrics-cluster"} 1`,
+		`gwylio_cluster_number_of_nodes{cluster="metrics-cluster"} 3`,
+	}
+
+	for _, line := range expectedLines {
+		if !strings.Contains(output.String(), line+"\n") {
+			t.Fail()
+			t.Log("Metrics output is missing line: ", line)
+		}
+	}
+}
+
+func TestWriteMetricsLeavesOutStaleClusters(t *testing.T) {
+	collectInterval := configuration.CollectInterval
+	configuration.CollectInterval = 30
+	defer func() { configuration.CollectInterval = collectInterval }()
+
+	recordClusterHealthMetrics(clusterHealth{ClusterName: "unreachable-cluster", Status: "green"})
+
+	metricsLock.Lock()
+	stale := clusterHealthStatMetrics["unreachable-cluster"]
+	stale.LastUpdated = time.Now().Add(time.Hour * -1)
+	clusterHealthStatMetrics["unreachable-cluster"] = stale
+	metricsLock.Unlock()
+
+	var output bytes.Buffer
+	writeMetrics(&output)
+
+	if strings.Contains(output.String(), "unreachable-cluster") {
+		t.Fail()
+		t.Logf("A cluster that hasn't been collected recently should be left out, was:\n%v", output.String())
+	}
+}
+
+func TestWriteMetricsNodeStats(t *testing.T) {
+	nodeStatsResponse := `{"name":"node-1","timestamp":1,
+		"indices":{"docs":{"count":42}},
+		"jvm":{"mem":{"heap_used_in_bytes":1024,"heap_max_in_bytes":2048},
+			"gc":{"collectors":{"young":{"collection_count":7,"collection_time_in_millis":1500}}}},
+		"thread_pool":{"search":{"rejected":2}},
+		"fs":{"total":{"total_in_bytes":100,"free_in_bytes":60,"available_in_bytes":50}}}`
+
+	var node elasticNodeStat
+	json.Unmarshal([]byte(nodeStatsResponse), &node)
+	recordNodeMetrics("metrics-cluster", node)
+
+	var output bytes.Buffer
+	writeMetrics(&output)
+
+	expectedLines := []string{
+		`gwylio_node_jvm_heap_used_bytes{cluster="metrics-cluster",node="node-1"} 1024`,
+		`gwylio_node_jvm_gc_collections_total{cluster="metrics-cluster",node="node-1",collector="young"} 7`,
+		`gwylio_node_jvm_gc_collection_seconds_total{cluster="metrics-cluster",node="node-1",collector="young"} 1.5`,
+		`gwylio_node_thread_pool_rejected_total{cluster="metrics-cluster",node="node-1",pool="search"} 2`,
+		`gwylio_node_fs_free_bytes{cluster="metrics-cluster",node="node-1"} 60`,
+		`gwylio_node_indices_docs{cluster="metrics-cluster",node="node-1"} 42`,
+	}
+
+	for _, line := range expectedLines {
+		if !strings.Contains(output.String(), line+"\n") {
+			t.Fail()
+			t.Log("Metrics output is missing line: ", line)
+		}
+	}
+}
+
+func TestEscapeLabelValue(t *testing.T) {
+	escaped := escapeLabelValue("a\"b\\c\nd")
+	expected := `a\"b\\c\nd`
+
+	if escaped != expected {
+		t.Fail()
+		t.Logf("Label value was not escaped. Should be %v, was %v", expected, escaped)
+	}
+}
@@ -1,13 +1,16 @@
 package elastic
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/howeyc/fsnotify"
@@ -19,10 +22,15 @@ func StartMonitoring() {
 	var wg sync.WaitGroup
 	wg.Add(1)
 	loadConfiguration()
+	detectClusterVersions()
 	initializeClusterHealthTracking()
+	initializeClusterCollectors()
 	loadNotificationRules()
+	loadSilences()
 	setupRulesWatcher()
+	startSpool()
 	startRetryQueue()
+	startHTTPListeners()
 
 	ticker := time.NewTicker(time.Second * time.Duration(configuration.CollectInterval))
 	go func() {
@@ -36,16 +44,26 @@ func StartMonitoring() {
 	wg.Wait()
 }
 
-// Loop through each Elastic cluster and collect stats
-func doMonitor() {
-	for _, hostCollection := range configuration.ElasticClientsFrom {
-		getNodeList(hostCollection.Hosts)
-		queryClusterHealth(hostCollection.Hosts)
-		queryNodeStats(hostCollection.Hosts)
-		queryCatchupNodes(hostCollection.Hosts)
+// Collect stats from every Elastic cluster at the same time. Returns the
+// cycle's collections, which can still be running if they passed the deadline.
+func doMonitor() *sync.WaitGroup {
+	deadline := time.Now().Add(collectTimeout())
+
+	var wg sync.WaitGroup
+	for _, collector := range clusterCollectors {
+		collector.start(deadline, &wg)
+	}
+	waitForCollections(&wg, deadline)
+	atomic.StoreInt64(&lastMonitorCycle, time.Now().UnixNano())
+
+	if !atomic.CompareAndSwapInt32(&rulesRunning, 0, 1) {
+		log.Print("Skipping rules, the last run is still going")
+		return &wg
 	}
+	defer atomic.StoreInt32(&rulesRunning, 0)
 
 	runNotificationRules()
+	return &wg
 }
 
 func setupRulesWatcher() {
@@ -63,19 +81,40 @@ func setupRulesWatcher() {
 		}
 	}()
 
-	err = watcher.Watch("rules")
-	if err != nil {
-		log.Fatal(err)
+	for _, folder := range startupOptions.RulesFolders {
+		if _, err := os.Stat(folder); os.IsNotExist(err) {
+			// No rules are loaded from a missing folder, so there is nothing to watch
+			log.Printf("rules folder %v does not exist. It isn't watched for changes.", folder)
+			continue
+		}
+
+		err = watcher.Watch(folder)
+		if err != nil {
+			log.Printf("Error watching rules folder %v : %v", folder, err)
+		}
 	}
 }
 
 // A utility function to provide http failover
 // If one http call fails (with a status other than 200), the next host in the line will be tried
 func failoverHTTPRequest(hosts []string, method string, url string, requestBody io.Reader) (body []byte, err error) {
+	// The body is read up front so each host gets the full request, not what was left by the last one
+	var requestBytes []byte
+	if requestBody != nil {
+		requestBytes, err = ioutil.ReadAll(requestBody)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	foundGoodHost := false
 	for _, host := range hosts {
 		if !foundGoodHost {
-			body, err = executeHTTPRequest(host, method, url, requestBody)
+			var hostBody io.Reader
+			if requestBody != nil {
+				hostBody = bytes.NewReader(requestBytes)
+			}
+			body, err = executeHTTPRequest(host, method, url, hostBody)
 			if err == nil && len(body) > 0 {
 				foundGoodHost = true
 			}
@@ -97,9 +136,7 @@ func executeHTTPRequest(host string, method string, url string, requestBody io.R
 		}
 	}()
 
-	client := http.Client{
-		Timeout: time.Duration(10 * time.Second),
-	}
+	client, security := clientForHost(host)
 
 	requestURL := fmt.Sprintf("%v/%v", host, url)
 	req, reqErr := http.NewRequest(method, requestURL, requestBody)
@@ -108,6 +145,11 @@ func executeHTTPRequest(host string, method string, url string, requestBody io.R
 		log.Print(reqErr)
 		err = reqErr
 	} else {
+		addAuthentication(req, security)
+		// Elasticsearch 6 and later reject request bodies without a content type
+		if requestBody != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
 		resp, reqErr := client.Do(req)
 		if reqErr != nil {
 			log.Print(reqErr)
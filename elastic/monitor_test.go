@@ -2,8 +2,11 @@ package elastic
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -80,3 +83,45 @@ func TestFailoverHTTPRequestFailsOnNoGoodServers(t *testing.T) {
 		t.Log("Request should have errored out")
 	}
 }
+
+func TestFailoverHTTPRequestResendsBodyToNextHost(t *testing.T) {
+
+	firstTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer firstTestServer.Close()
+
+	secondTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestBody, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintln(w, string(requestBody))
+	}))
+	defer secondTestServer.Close()
+
+	hosts := []string{firstTestServer.URL, secondTestServer.URL}
+
+	body, err := failoverHTTPRequest(hosts, "POST", "_bulk", strings.NewReader("bulkbody"))
+	if err != nil {
+		t.Fail()
+		t.Log(err)
+	}
+
+	if !strings.Contains(string(body), "bulkbody") {
+		t.Fail()
+		t.Log("Request body should have been sent to secondTestServer, was ", string(body))
+	}
+}
+
+func TestRulesWatcherSkipsMissingFolders(t *testing.T) {
+	folder, err := ioutil.TempDir("", "gwylio-rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	SetStartupOptions(StartupOptions{RulesFolders: []string{filepath.Join(folder, "missing")}})
+	defer SetStartupOptions(DefaultStartupOptions())
+
+	// ruleFiles and validate allow a missing folder, so it shouldn't stop
+	// the process either
+	setupRulesWatcher()
+}
@@ -0,0 +1,321 @@
+package elastic
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Name of the aggregation a new_term rule's query is wrapped in
+const newTermAggregationName = "gwylio_new_term"
+
+// Name of the composite aggregation's source for the rule's field
+const newTermSourceName = "term"
+
+const (
+	// Days of values to learn before new ones are alerted on
+	defaultNewTermLookback = 30
+
+	// Number of values read from each query, or each page of a composite
+	// aggregation
+	defaultNewTermSize = 1000
+)
+
+// Folder in the state directory known terms are saved in
+const newTermStateFolder = "new_terms"
+
+// The values seen for a new_term rule's field, and when each was last seen
+type knownTerms struct {
+	Field string               `json:"field"`
+	Terms map[string]time.Time `json:"terms"`
+}
+
+func validateNewTermRule(rule notificationRule) error {
+	if rule.NewTermField == "" {
+		return errors.New("new_term_field must be set")
+	}
+	return nil
+}
+
+// Adds the terms to the known set and returns the ones that weren't in it
+func (known *knownTerms) add(terms []string, now time.Time) []string {
+	var newTerms []string
+	for _, term := range terms {
+		if _, ok := known.Terms[term]; !ok {
+			newTerms = append(newTerms, term)
+		}
+		known.Terms[term] = now
+	}
+
+	sort.Strings(newTerms)
+	return newTerms
+}
+
+// Forgets terms that haven't been seen since the cutoff
+func (known *knownTerms) expire(cutoff time.Time) {
+	for term, lastSeen := range known.Terms {
+		if lastSeen.Before(cutoff) {
+			delete(known.Terms, term)
+		}
+	}
+}
+
+// Alerts on values of the rule's field that haven't been seen in the
+// lookback window. On the first run the lookback window is read to learn
+// the known values, and nothing is alerted on.
+func processNewTermRule(rule *notificationRule, hosts []string, version clusterVersion) error {
+	now := time.Now()
+
+	lookback := rule.NewTermLookback
+	if lookback <= 0 {
+		lookback = defaultNewTermLookback
+	}
+
+	// Terms learned for a different field are no use after the rule changes
+	if rule.KnownTerms != nil && rule.KnownTerms.Field != rule.NewTermField {
+		rule.KnownTerms = nil
+	}
+
+	if rule.KnownTerms == nil {
+		rule.KnownTerms = loadKnownTerms(rule)
+	}
+
+	if rule.KnownTerms == nil {
+		terms, err := queryTerms(rule, hosts, version, timeWindow{From: fmt.Sprintf("now-%vd", lookback), To: "now"})
+		if err != nil {
+			return err
+		}
+
+		rule.KnownTerms = &knownTerms{Field: rule.NewTermField, Terms: map[string]time.Time{}}
+		rule.KnownTerms.add(terms, now)
+		log.Printf("Learned %v values of %v for rule %v", len(rule.KnownTerms.Terms), rule.NewTermField, rule.Name)
+
+		saveKnownTerms(rule)
+		return nil
+	}
+
+	// Runs are allowed to overlap, terms seen twice are only new once
+	window := rule.Interval * 2
+	if window < 1 {
+		window = 1
+	}
+
+	terms, err := queryTerms(rule, hosts, version, timeWindow{From: fmt.Sprintf("now-%vm", window), To: "now"})
+	if err != nil {
+		return err
+	}
+
+	newTerms := rule.KnownTerms.add(terms, now)
+	rule.KnownTerms.expire(now.AddDate(0, 0, -lookback))
+	saveKnownTerms(rule)
+
+	if len(newTerms) == 0 {
+		recordAlertHistory(ruleEvaluationHistory(rule, ruleResult{Description: "No new values"}, historyStatusOK))
+		return nil
+	}
+
+	rule.LastNotificationSent = now
+
+	result := ruleResult{
+		Value:       float64(len(newTerms)),
+		Description: fmt.Sprintf("New values for %v: %v", rule.NewTermField, strings.Join(newTerms, ", ")),
+	}
+	for _, term := range newTerms {
+		result.Buckets = append(result.Buckets, notificationBucket{Key: term})
+	}
+
+	message, messageTemplate := buildRuleMessage(rule, result, alertStateFiring,
+		fmt.Sprintf("%v %v", rule.NotificationMessage, result.Description), "%v")
+
+	// Each new value is a one off event, so there is nothing to resolve
+	sendNotification(alertNotification{
+		Key:         ruleAlertKey(rule.Name),
+		Status:      alertStateFiring,
+		ClusterName: rule.ClusterName,
+		RuleName:    rule.Name,
+		Message:     message,
+		Template:    messageTemplate,
+		Severity:    rule.Severity,
+		KibanaURL:   ruleKibanaURL(rule),
+		Value:       result.Value,
+		Operator:    ">",
+		Timestamp:   now,
+		FiringSince: now,
+		Overrides:   rule.NotificationOverrides,
+	})
+
+	return nil
+}
+
+// Reads every value of the rule's field in the window. Clusters that
+// support composite aggregations are paged through new_term_size values at
+// a time; older ones only return the top new_term_size values.
+func queryTerms(rule *notificationRule, hosts []string, version clusterVersion, window timeWindow) ([]string, error) {
+	var terms []string
+	var after json.RawMessage
+	for {
+		query, err := buildNewTermQuery(rule, window, version, after)
+		if err != nil {
+			return nil, err
+		}
+
+		body, err := failoverHTTPRequest(hosts, "POST", buildRuleURL(rule, version), bytes.NewBuffer(query))
+		if err != nil {
+			return nil, err
+		}
+
+		page, err := parseNewTermQuery(body)
+		if err != nil {
+			return nil, err
+		}
+
+		terms = append(terms, page.Terms...)
+
+		if page.OtherDocCount > 0 {
+			log.Printf("Warning: rule %v only read the top %v values of %v, values past them will be treated as new. Raise new_term_size, or upgrade to Elasticsearch 6.1 or later to read every value",
+				rule.Name, len(page.Terms), rule.NewTermField)
+		}
+
+		if len(page.Terms) == 0 || len(page.AfterKey) == 0 {
+			return terms, nil
+		}
+		after = page.AfterKey
+	}
+}
+
+// Limits the rule's query to the window and adds an aggregation on the
+// rule's field. The after key of the previous page is used to read the
+// next one from a composite aggregation.
+func buildNewTermQuery(rule *notificationRule, window timeWindow, version clusterVersion, after json.RawMessage) ([]byte, error) {
+	timestampField := rule.TimestampField
+	if timestampField == "" {
+		timestampField = defaultTimestampField
+	}
+
+	windowQuery, err := buildWindowQuery(rule.Query, timestampField, window)
+	if err != nil {
+		return nil, err
+	}
+
+	body := map[string]json.RawMessage{}
+	err = json.Unmarshal(windowQuery, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	size := rule.NewTermSize
+	if size <= 0 {
+		size = defaultNewTermSize
+	}
+
+	aggregation := map[string]interface{}{
+		"terms": map[string]interface{}{"field": rule.NewTermField, "size": size},
+	}
+
+	if version.compositeAggregation() {
+		composite := map[string]interface{}{
+			"size": size,
+			"sources": []interface{}{
+				map[string]interface{}{
+					newTermSourceName: map[string]interface{}{"terms": map[string]interface{}{"field": rule.NewTermField}},
+				},
+			},
+		}
+		if len(after) > 0 {
+			composite["after"] = after
+		}
+		aggregation = map[string]interface{}{"composite": composite}
+	}
+
+	aggs, err := json.Marshal(map[string]interface{}{newTermAggregationName: aggregation})
+	if err != nil {
+		return nil, err
+	}
+
+	body["size"] = json.RawMessage("0")
+	body["aggs"] = aggs
+
+	return json.Marshal(body)
+}
+
+// One page of a new_term rule's values
+type newTermPage struct {
+	Terms []string
+
+	// Key to read the next page of a composite aggregation from, empty if
+	// there are no more
+	AfterKey json.RawMessage
+
+	// Documents with values the terms aggregation left out
+	OtherDocCount int
+}
+
+type newTermQueryResult struct {
+	Aggregations map[string]newTermAggregation `json:"aggregations"`
+}
+
+type newTermAggregation struct {
+	Buckets       []queryKeyBucket `json:"buckets"`
+	AfterKey      json.RawMessage  `json:"after_key"`
+	OtherDocCount int              `json:"sum_other_doc_count"`
+}
+
+// Parses a terms or composite aggregation response
+func parseNewTermQuery(result []byte) (newTermPage, error) {
+	var queryResult newTermQueryResult
+	err := json.Unmarshal(result, &queryResult)
+	if err != nil {
+		return newTermPage{}, err
+	}
+
+	aggregation, ok := queryResult.Aggregations[newTermAggregationName]
+	if !ok {
+		return newTermPage{}, errors.New("new term aggregation missing from response")
+	}
+
+	page := newTermPage{AfterKey: aggregation.AfterKey, OtherDocCount: aggregation.OtherDocCount}
+	for _, bucket := range aggregation.Buckets {
+		// Composite bucket keys are an object with a value for each source
+		var sources map[string]json.RawMessage
+		if json.Unmarshal(bucket.Key, &sources) == nil {
+			// Elasticsearch 6.1 and 6.2 don't return after_key, the last
+			// bucket's key is used instead
+			if len(aggregation.AfterKey) == 0 {
+				page.AfterKey = bucket.Key
+			}
+			bucket = queryKeyBucket{Key: sources[newTermSourceName]}
+		}
+		page.Terms = append(page.Terms, bucket.keyValue())
+	}
+
+	return page, nil
+}
+
+// Reads the rule's known terms from the state directory. Returns nil if
+// there are none, or they were learned for a different field.
+func loadKnownTerms(rule *notificationRule) *knownTerms {
+	var known knownTerms
+	found, err := loadStateFile(statePath(newTermStateFolder, rule.Name), &known)
+	if err != nil {
+		log.Printf("Error reading known terms for rule %v : %v", rule.Name, err)
+		return nil
+	}
+
+	if !found || known.Field != rule.NewTermField || known.Terms == nil {
+		return nil
+	}
+
+	return &known
+}
+
+func saveKnownTerms(rule *notificationRule) {
+	err := saveStateFile(statePath(newTermStateFolder, rule.Name), rule.KnownTerms)
+	if err != nil {
+		log.Printf("Error saving known terms for rule %v : %v", rule.Name, err)
+	}
+}
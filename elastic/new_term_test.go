@@ -0,0 +1,171 @@
+package elastic
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKnownTermsAddAndExpire(t *testing.T) {
+	now := time.Now()
+	known := knownTerms{Field: "user_agent", Terms: map[string]time.Time{
+		"curl":  now.AddDate(0, 0, -40),
+		"wget":  now.AddDate(0, 0, -1),
+		"httpd": now.AddDate(0, 0, -1),
+	}}
+
+	newTerms := known.add([]string{"python", "curl", "go-http-client"}, now)
+
+	if strings.Join(newTerms, ",") != "go-http-client,python" {
+		t.Fail()
+		t.Logf("Only unseen terms should be returned, was %v", newTerms)
+	}
+
+	known.expire(now.AddDate(0, 0, -30))
+
+	if _, ok := known.Terms["curl"]; !ok {
+		t.Fail()
+		t.Logf("curl was just seen again and shouldn't be expired")
+	}
+
+	known.Terms["wget"] = now.AddDate(0, 0, -31)
+	known.expire(now.AddDate(0, 0, -30))
+
+	if _, ok := known.Terms["wget"]; ok {
+		t.Fail()
+		t.Logf("wget hasn't been seen in the lookback window and should be expired")
+	}
+}
+
+func TestParseNewTermQuery(t *testing.T) {
+	response := `{"aggregations":{"gwylio_new_term":{"buckets":[{"key":"curl","doc_count":4},{"key":"wget","doc_count":1}]}}}`
+
+	page, err := parseNewTermQuery([]byte(response))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(page.Terms, ",") != "curl,wget" || len(page.AfterKey) != 0 {
+		t.Fail()
+		t.Logf("Terms are incorrect, was %v", page.Terms)
+	}
+
+	composite := `{"aggregations":{"gwylio_new_term":{"after_key":{"term":404},"buckets":[{"key":{"term":200},"doc_count":4},{"key":{"term":404},"doc_count":1}]}}}`
+
+	page, err = parseNewTermQuery([]byte(composite))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(page.Terms, ",") != "200,404" || string(page.AfterKey) != `{"term":404}` {
+		t.Fail()
+		t.Logf("Composite terms are incorrect, was %v after %s", page.Terms, page.AfterKey)
+	}
+}
+
+func TestQueryTermsPagesThroughEveryValue(t *testing.T) {
+	pages := []string{
+		`{"after_key":{"term":"10.0.0.2"},"buckets":[{"key":{"term":"10.0.0.1"},"doc_count":3},{"key":{"term":"10.0.0.2"},"doc_count":1}]}`,
+		`{"after_key":{"term":"10.0.0.3"},"buckets":[{"key":{"term":"10.0.0.3"},"doc_count":2}]}`,
+		`{"buckets":[]}`,
+	}
+
+	var queries []string
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		queries = append(queries, string(body))
+		if len(queries) > len(pages) {
+			http.Error(w, "too many pages", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"aggregations":{"gwylio_new_term":%v}}`, pages[len(queries)-1])
+	}))
+	defer testServer.Close()
+
+	rule := notificationRule{Name: "New source addresses", Type: "new_term", NewTermField: "source_ip", NewTermSize: 2}
+	version := clusterVersion{Distribution: distributionElasticsearch, Number: "7.17.9", Major: 7, Minor: 17}
+
+	terms, err := queryTerms(&rule, []string{testServer.URL}, version, timeWindow{From: "now-30d", To: "now"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(terms, ",") != "10.0.0.1,10.0.0.2,10.0.0.3" {
+		t.Fail()
+		t.Logf("Every page of values should be read, was %v", terms)
+	}
+
+	if len(queries) != 3 || !strings.Contains(queries[0], `"composite"`) || strings.Contains(queries[0], `"after"`) ||
+		!strings.Contains(queries[1], `"after":{"term":"10.0.0.2"}`) || !strings.Contains(queries[2], `"after":{"term":"10.0.0.3"}`) {
+		t.Fail()
+		t.Logf("Each page should be read after the last one, queries were %v", queries)
+	}
+}
+
+func TestProcessNewTermRule(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "gwylio-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+
+	configuration.StateDirectory = stateDir
+	configuration.Notifications = nil
+	defer func() { configuration.StateDirectory = "" }()
+
+	terms := `{"key":"curl","doc_count":4}`
+	var lastQuery string
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lastQuery = string(body)
+		fmt.Fprintf(w, `{"aggregations":{"gwylio_new_term":{"buckets":[%v]}}}`, terms)
+	}))
+	defer testServer.Close()
+
+	rule := notificationRule{Name: "New user agents", Type: "new_term", NewTermField: "user_agent", Interval: 5}
+	hosts := []string{testServer.URL}
+
+	err = processNewTermRule(&rule, hosts, clusterVersion{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(lastQuery, "now-30d") {
+		t.Fail()
+		t.Logf("First run should read the lookback window, query was %v", lastQuery)
+	}
+
+	if !rule.LastNotificationSent.IsZero() {
+		t.Fail()
+		t.Logf("First run should only learn terms, not notify")
+	}
+
+	// A restart should pick up the saved terms rather than learning again
+	rule = notificationRule{Name: "New user agents", Type: "new_term", NewTermField: "user_agent", Interval: 5}
+	terms = `{"key":"curl","doc_count":1},{"key":"sqlmap","doc_count":1}`
+
+	err = processNewTermRule(&rule, hosts, clusterVersion{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(lastQuery, "now-10m") {
+		t.Fail()
+		t.Logf("Later runs should read the last two intervals, query was %v", lastQuery)
+	}
+
+	if rule.LastNotificationSent.IsZero() {
+		t.Fail()
+		t.Logf("A notification should be sent for sqlmap")
+	}
+
+	if _, ok := rule.KnownTerms.Terms["sqlmap"]; !ok {
+		t.Fail()
+		t.Logf("sqlmap should be known after it has been alerted on")
+	}
+}
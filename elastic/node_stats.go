@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -89,6 +90,7 @@ type clusterHealth struct {
 }
 
 type clusterHealthMonitor struct {
+	sync.Mutex
 	ClusterName                      string
 	NumberOfNodes                    int
 	ClusterState                     string
@@ -96,21 +98,35 @@ type clusterHealthMonitor struct {
 	LastGoodClusterStatusDate        time.Time
 	LastNodeCountNotificationTime    time.Time
 	LastClusterStateNotificationDate time.Time
+	NodeCountAlert                   alertState
+	ClusterStateAlert                alertState
 }
 
-// Tracks the nodes that are being processed in this particular processing run
-var nodeList []elasticNode
-var clusterHealthTracking []clusterHealthMonitor
+// Tracks the nodes that are being processed in a cluster's processing run
+type nodeTracker struct {
+	nodeList []elasticNode
+}
+
+var clusterHealthTracking []*clusterHealthMonitor
 
 // Initialize clusterHealthTracking with the configuration data
 func initializeClusterHealthTracking() {
 	for _, cluster := range configuration.ElasticClientsFrom {
-		var newMonitor clusterHealthMonitor
-		newMonitor.ClusterName = cluster.ClusterName
+		newMonitor := &clusterHealthMonitor{ClusterName: cluster.ClusterName}
+		restoreClusterState(newMonitor)
 		clusterHealthTracking = append(clusterHealthTracking, newMonitor)
 	}
 }
 
+func clusterHealthMonitorFor(clusterName string) *clusterHealthMonitor {
+	for _, clusterMonitor := range clusterHealthTracking {
+		if clusterMonitor.ClusterName == clusterName {
+			return clusterMonitor
+		}
+	}
+	return nil
+}
+
 // Converts current time into epocmills
 func getCurrentTimeInMills() int64 {
 	timeinmills := time.Now().UnixNano() / 1000000
@@ -118,17 +134,18 @@ func getCurrentTimeInMills() int64 {
 }
 
 // Gets a list of the nodes that are currently running on the Elasticsearch cluster
-func getNodeList(hosts []string) {
+func (tracker *nodeTracker) getNodeList(hosts []string) error {
 	body, err := failoverHTTPRequest(hosts, "GET", "_cat/nodes", nil)
 	if err == nil {
-		parseNodeList(string(body))
+		tracker.parseNodeList(string(body))
 	}
+	return err
 }
 
 // Parses the list of nodes from the _cat/nodes call
-func parseNodeList(data string) {
+func (tracker *nodeTracker) parseNodeList(data string) {
 	nodeLines := strings.Split(data, "\n")
-	nodeList = []elasticNode{}
+	tracker.nodeList = []elasticNode{}
 	for _, value := range nodeLines {
 		nodeCols := strings.Split(strings.Trim(value, " "), " ")
 
@@ -137,15 +154,15 @@ func parseNodeList(data string) {
 		node.Host = nodeCols[0]
 		node.Processed = false
 		if node.Name != "" {
-			nodeList = append(nodeList, node)
+			tracker.nodeList = append(tracker.nodeList, node)
 		}
 	}
 }
 
 // updates nodeList array with whether or not the node has been processed
-func setNodeAsProcessed(nodeName string) {
-	for i := 0; i < len(nodeList); i++ {
-		nodeValue := &nodeList[i]
+func (tracker *nodeTracker) setNodeAsProcessed(nodeName string) {
+	for i := 0; i < len(tracker.nodeList); i++ {
+		nodeValue := &tracker.nodeList[i]
 		if nodeValue.Name == nodeName {
 			nodeValue.Processed = true
 		}
@@ -153,10 +170,10 @@ func setNodeAsProcessed(nodeName string) {
 }
 
 // checks the nodeList array to see if a given node has been processed yet
-func hasNodeBeenProcessed(nodeName string) bool {
+func (tracker *nodeTracker) hasNodeBeenProcessed(nodeName string) bool {
 	hasBeenProcessed := false
-	for i := 0; i < len(nodeList); i++ {
-		nodeValue := &nodeList[i]
+	for i := 0; i < len(tracker.nodeList); i++ {
+		nodeValue := &tracker.nodeList[i]
 		if nodeValue.Name == nodeName {
 			hasBeenProcessed = nodeValue.Processed
 		}
@@ -167,15 +184,16 @@ func hasNodeBeenProcessed(nodeName string) bool {
 // Gets the details of node stats for the cluster
 // Client only nodes other than the one being queried will not show up in this result set and
 // must be processed after in the catchup node processing
-func queryNodeStats(hosts []string) {
+func (tracker *nodeTracker) queryNodeStats(hosts []string) error {
 	body, err := failoverHTTPRequest(hosts, "GET", "_nodes/stats", nil)
 	if err == nil {
-		processNodeStatsBody(body)
+		tracker.processNodeStatsBody(body)
 	}
+	return err
 }
 
 // Parse and process the json from the _nodes/stats call
-func processNodeStatsBody(body []byte) {
+func (tracker *nodeTracker) processNodeStatsBody(body []byte) {
 	var nodesStats nodesStats
 	json.Unmarshal(body, &nodesStats)
 	var dat map[string]json.RawMessage
@@ -197,7 +215,8 @@ func processNodeStatsBody(body []byte) {
 		indexStatData(processStats{subStat, &node.ProcessStats}, "process_stats")
 		indexStatData(threadStats{subStat, &node.ThreadStats}, "thread_stats")
 
-		setNodeAsProcessed(node.Name)
+		recordNodeMetrics(nodesStats.ClusterName, node)
+		tracker.setNodeAsProcessed(node.Name)
 	}
 }
 
@@ -209,37 +228,39 @@ func indexStatData(stats interface{}, docType string) {
 
 // query the Elasticsearch cluster for overall cluster health
 
-func queryClusterHealth(hosts []string) {
+func queryClusterHealth(hosts []string, clusterMonitor *clusterHealthMonitor, expectedNodeCount int) error {
 	body, err := failoverHTTPRequest(hosts, "GET", "_cluster/health", nil)
 	if err == nil {
-		processClusterHealthBody(body)
+		processClusterHealthBody(body, clusterMonitor, expectedNodeCount)
 	}
+	return err
 }
 
 // Parse and process JSON returned from the _cluster/health call.
-func processClusterHealthBody(body []byte) {
+func processClusterHealthBody(body []byte, clusterMonitor *clusterHealthMonitor, expectedNodeCount int) {
 	var rawmsg clusterHealth
 	json.Unmarshal(body, &rawmsg)
 
 	clusterhealth := clusterHealthStats{getCurrentTimeInMills(), rawmsg}
 	indexStatData(clusterhealth, "cluster_stats")
-	checkClusterHealth(clusterhealth.Stats)
+	recordClusterHealthMetrics(clusterhealth.Stats)
+	checkClusterHealth(clusterhealth.Stats, clusterMonitor, expectedNodeCount)
 
 }
 
 // Query and process client only nodes that were missed due to Elasticsearch
 // not returning results for client only nodes different than the one being
 // queried directly.
-func queryCatchupNodes(hosts []string) {
-	for _, nodeValue := range nodeList {
+func (tracker *nodeTracker) queryCatchupNodes(hosts []string) {
+	for _, nodeValue := range tracker.nodeList {
 		if !nodeValue.Processed {
-			processCatchupNode(nodeValue.Name, hosts)
+			tracker.processCatchupNode(nodeValue.Name, hosts)
 		}
 	}
 }
 
 // Process each catchup node
-func processCatchupNode(nodeName string, hosts []string) {
+func (tracker *nodeTracker) processCatchupNode(nodeName string, hosts []string) {
 
 	// We have to loop through each host and check for an actual results since the
 	// http call will return success, but without data.
@@ -248,8 +269,8 @@ func processCatchupNode(nodeName string, hosts []string) {
 		singleHostAsArray = append(singleHostAsArray, host)
 		body, err := failoverHTTPRequest(singleHostAsArray, "GET",
 			fmt.Sprintf("_nodes/%v/stats", nodeName), nil)
-		if err == nil && !hasNodeBeenProcessed(nodeName) {
-			processNodeStatsBody(body)
+		if err == nil && !tracker.hasNodeBeenProcessed(nodeName) {
+			tracker.processNodeStatsBody(body)
 		}
 	}
 }
@@ -258,61 +279,119 @@ func processCatchupNode(nodeName string, hosts []string) {
 func indexDocument(document string, docType string) {
 
 	// Build out the index name with a daily suffix
-	var urlBuffer bytes.Buffer
-	urlBuffer.WriteString(configuration.IndexPrefix)
-	urlBuffer.WriteString(time.Now().Format("-2006.01.02/"))
-	urlBuffer.WriteString(docType)
+	var indexBuffer bytes.Buffer
+	indexBuffer.WriteString(configuration.IndexPrefix)
+	indexBuffer.WriteString(time.Now().Format("-2006.01.02"))
 
-	addToIndexQueue(urlBuffer.String(), document)
+	addToIndexQueue(indexBuffer.String(), docType, document)
 }
 
-// we already have this data, so no need to do a separate query to get it
-func checkClusterHealth(cluster clusterHealth) {
-
-	var clusterMonitor *clusterHealthMonitor
-
-	for i := 0; i < len(clusterHealthTracking); i++ {
-		if clusterHealthTracking[i].ClusterName == cluster.ClusterName {
-			clusterMonitor = &clusterHealthTracking[i]
-		}
+// we already have this data, so no need to do a separate query to get it.
+// Notifiers make network calls, so notifications are sent once the monitor
+// is unlocked, rather than holding up the status api and metrics.
+func checkClusterHealth(cluster clusterHealth, clusterMonitor *clusterHealthMonitor, expectedNodeCount int) {
+
+	clusterMonitor.Lock()
+	previousState := clusterMonitor.savedState()
+	notifications := updateClusterHealth(cluster, clusterMonitor, expectedNodeCount)
+	state := clusterMonitor.savedState()
+	clusterMonitor.Unlock()
+
+	// Save the notification times and alert states when they change, so a
+	// restart doesn't send the same notifications again
+	if state != previousState {
+		saveClusterState(clusterMonitor.ClusterName, state)
 	}
 
-	if configuration.NotifyOnNodeCountChange {
-		expectedNodeCount := 0
+	for _, notification := range notifications {
+		sendNotification(notification)
+	}
+}
 
-		for _, clusterConfig := range configuration.ElasticClientsFrom {
-			if clusterConfig.ClusterName == cluster.ClusterName {
-				expectedNodeCount = clusterConfig.ExpectedNodeCount
-			}
-		}
+// Updates the monitor from the cluster's health and returns the
+// notifications to send. The monitor must be locked.
+func updateClusterHealth(cluster clusterHealth, clusterMonitor *clusterHealthMonitor, expectedNodeCount int) []alertNotification {
+	var notifications []alertNotification
 
+	if configuration.NotifyOnNodeCountChange {
 		clusterMonitor.NumberOfNodes = cluster.NumberOfNodes
 
 		if expectedNodeCount == cluster.NumberOfNodes {
 			clusterMonitor.LastGoodNodeCountDate = time.Now()
+
+			if duration, resolved := clusterMonitor.NodeCountAlert.resolve(time.Now()); resolved {
+				notifications = append(notifications, alertNotification{
+					Key:         clusterAlertKey(clusterMonitor.ClusterName, "node_count"),
+					Status:      alertStateResolved,
+					ClusterName: clusterMonitor.ClusterName,
+					Message: fmt.Sprintf("Resolved: Node count for %v is back to %v after %v",
+						cluster.ClusterName, cluster.NumberOfNodes, formatIncidentDuration(duration)),
+					Value:       float64(cluster.NumberOfNodes),
+					Threshold:   float64(expectedNodeCount),
+					Operator:    "!=",
+					Severity:    severityCritical,
+					Timestamp:   time.Now(),
+					FiringSince: clusterMonitor.NodeCountAlert.FiringSince,
+				})
+			}
 		} else {
 			// Only notify if the last known state was more than a minute ago.
 			if clusterMonitor.LastGoodNodeCountDate.Before(time.Now().Add(time.Minute * -1)) {
 				// Only notify once an hour
 				if clusterMonitor.LastNodeCountNotificationTime.Before(time.Now().Add(time.Hour * -1)) {
 
-					sendNotification(fmt.Sprintf("Node count changed for %v. Expected %v, found %v",
-						cluster.ClusterName, expectedNodeCount, cluster.NumberOfNodes),
-						nil, notificationOverrides{})
+					notifications = append(notifications, alertNotification{
+						Key:         clusterAlertKey(clusterMonitor.ClusterName, "node_count"),
+						Status:      alertStateFiring,
+						ClusterName: clusterMonitor.ClusterName,
+						Message: fmt.Sprintf("Node count changed for %v. Expected %v, found %v",
+							cluster.ClusterName, expectedNodeCount, cluster.NumberOfNodes),
+						Value:       float64(cluster.NumberOfNodes),
+						Threshold:   float64(expectedNodeCount),
+						Operator:    "!=",
+						Severity:    severityCritical,
+						Timestamp:   time.Now(),
+						FiringSince: clusterMonitor.LastGoodNodeCountDate,
+					})
 
 					clusterMonitor.LastNodeCountNotificationTime = time.Now()
+					clusterMonitor.NodeCountAlert.fire(clusterMonitor.LastGoodNodeCountDate)
 				}
 			}
 		}
 	}
 
+	clusterMonitor.ClusterState = cluster.Status
+
 	if cluster.Status == "green" {
 		clusterMonitor.LastGoodClusterStatusDate = time.Now()
+
+		if duration, resolved := clusterMonitor.ClusterStateAlert.resolve(time.Now()); resolved {
+			notifications = append(notifications, alertNotification{
+				Key:         clusterAlertKey(clusterMonitor.ClusterName, "cluster_state"),
+				Status:      alertStateResolved,
+				ClusterName: clusterMonitor.ClusterName,
+				Message: fmt.Sprintf("Resolved: Cluster state is green for %v after %v",
+					cluster.ClusterName, formatIncidentDuration(duration)),
+				Severity:    clusterMonitor.ClusterStateAlert.Severity,
+				Timestamp:   time.Now(),
+				FiringSince: clusterMonitor.ClusterStateAlert.FiringSince,
+			})
+		}
 	} else {
+		severity := clusterStateSeverity(cluster.Status)
+
+		// Only notify once an hour, unless a yellow cluster has gone red since
+		// the last notification
+		escalated := clusterMonitor.ClusterStateAlert.isFiring() &&
+			clusterMonitor.ClusterStateAlert.Severity != severityCritical && severity == severityCritical
+		throttled := !escalated &&
+			!clusterMonitor.LastClusterStateNotificationDate.Before(time.Now().Add(time.Hour*-1))
+
 		notify := false
 		if configuration.NotifyOnClusterRed &&
 			cluster.Status == "red" &&
-			clusterMonitor.LastClusterStateNotificationDate.Before(time.Now().Add(time.Hour*-1)) &&
+			!throttled &&
 			clusterMonitor.LastGoodClusterStatusDate.Before(time.Now().Add(time.Minute*-1)) {
 
 			notify = true
@@ -320,18 +399,28 @@ func checkClusterHealth(cluster clusterHealth) {
 
 		if configuration.NotifyOnClusterYellow &&
 			cluster.Status == "yellow" &&
-			clusterMonitor.LastClusterStateNotificationDate.Before(time.Now().Add(time.Hour*-1)) &&
+			!throttled &&
 			clusterMonitor.LastGoodClusterStatusDate.Before(time.Now().Add(time.Minute*-1)) {
 
 			notify = true
 		}
 
 		if notify {
-			sendNotification(fmt.Sprintf("Cluster state is %v for %v", cluster.Status, cluster.ClusterName),
-				nil, notificationOverrides{})
+			notifications = append(notifications, alertNotification{
+				Key:         clusterAlertKey(clusterMonitor.ClusterName, "cluster_state"),
+				Status:      alertStateFiring,
+				ClusterName: clusterMonitor.ClusterName,
+				Message:     fmt.Sprintf("Cluster state is %v for %v", cluster.Status, cluster.ClusterName),
+				Severity:    severity,
+				Timestamp:   time.Now(),
+				FiringSince: clusterMonitor.LastGoodClusterStatusDate,
+			})
 			clusterMonitor.LastClusterStateNotificationDate = time.Now()
+			clusterMonitor.ClusterStateAlert.fire(clusterMonitor.LastGoodClusterStatusDate)
+			clusterMonitor.ClusterStateAlert.Severity = severity
 		}
 
 	}
 
+	return notifications
 }
@@ -1,6 +1,11 @@
 package elastic
 
-import "testing"
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
 
 func TestParseNodeList(t *testing.T) {
 
@@ -10,55 +15,56 @@ func TestParseNodeList(t *testing.T) {
 10.0.0.2 10.0.0.2           49          97 0.24 d         m      node-2 
 10.0.0.3 10.0.0.3           18          93 0.39 d         m      node-3`
 
-	parseNodeList(nodeListResponse)
+	var tracker nodeTracker
+	tracker.parseNodeList(nodeListResponse)
 
-	nodeCount := len(nodeList)
+	nodeCount := len(tracker.nodeList)
 	if nodeCount != exepectedNodeCount {
 		t.Fail()
 		t.Logf("Node Count is incorrect. Should be %v, was %v", exepectedNodeCount, nodeCount)
 	}
 
-	if nodeList[0].Host != "10.0.0.1" {
+	if tracker.nodeList[0].Host != "10.0.0.1" {
 		t.Fail()
-		t.Logf("nodeList[0].Host is incorrect. Should be %v, was %v", "10.0.0.1", nodeList[0].Host)
+		t.Logf("nodeList[0].Host is incorrect. Should be %v, was %v", "10.0.0.1", tracker.nodeList[0].Host)
 	}
 
-	if nodeList[0].Name != "node-1" {
+	if tracker.nodeList[0].Name != "node-1" {
 		t.Fail()
-		t.Logf("nodeList[0].Host is incorrect. Should be %v, was %v", "node-1", nodeList[0].Name)
+		t.Logf("nodeList[0].Host is incorrect. Should be %v, was %v", "node-1", tracker.nodeList[0].Name)
 	}
 
-	if nodeList[0].Processed {
+	if tracker.nodeList[0].Processed {
 		t.Fail()
 		t.Logf("nodeList[0].Processed should be false")
 	}
 
-	if nodeList[1].Host != "10.0.0.2" {
+	if tracker.nodeList[1].Host != "10.0.0.2" {
 		t.Fail()
-		t.Logf("nodeList[1].Host is incorrect. Should be %v, was %v", "10.0.0.2", nodeList[1].Host)
+		t.Logf("nodeList[1].Host is incorrect. Should be %v, was %v", "10.0.0.2", tracker.nodeList[1].Host)
 	}
 
-	if nodeList[1].Name != "node-2" {
+	if tracker.nodeList[1].Name != "node-2" {
 		t.Fail()
-		t.Logf("nodeList[1].Host is incorrect. Should be %v, was %v", "node-2", nodeList[1].Name)
+		t.Logf("nodeList[1].Host is incorrect. Should be %v, was %v", "node-2", tracker.nodeList[1].Name)
 	}
 
-	if nodeList[1].Processed {
+	if tracker.nodeList[1].Processed {
 		t.Fail()
 		t.Logf("nodeList[1].Processed should be false")
 	}
 
-	if nodeList[2].Host != "10.0.0.3" {
+	if tracker.nodeList[2].Host != "10.0.0.3" {
 		t.Fail()
-		t.Logf("nodeList[2].Host is incorrect. Should be %v, was %v", "10.0.0.3", nodeList[2].Host)
+		t.Logf("nodeList[2].Host is incorrect. Should be %v, was %v", "10.0.0.3", tracker.nodeList[2].Host)
 	}
 
-	if nodeList[2].Name != "node-3" {
+	if tracker.nodeList[2].Name != "node-3" {
 		t.Fail()
-		t.Logf("nodeList[2].Host is incorrect. Should be %v, was %v", "node-3", nodeList[2].Name)
+		t.Logf("nodeList[2].Host is incorrect. Should be %v, was %v", "node-3", tracker.nodeList[2].Name)
 	}
 
-	if nodeList[2].Processed {
+	if tracker.nodeList[2].Processed {
 		t.Fail()
 		t.Logf("nodeList[2].Processed should be false")
 	}
@@ -69,16 +75,17 @@ func TestSetNodeAsProcessed(t *testing.T) {
 10.0.0.2 10.0.0.2           49          97 0.24 d         m      node-2 
 10.0.0.3 10.0.0.3           18          93 0.39 d         m      node-3`
 
-	parseNodeList(nodeListResponse)
+	var tracker nodeTracker
+	tracker.parseNodeList(nodeListResponse)
 
-	setNodeAsProcessed("node-1")
+	tracker.setNodeAsProcessed("node-1")
 
-	if !nodeList[0].Processed {
+	if !tracker.nodeList[0].Processed {
 		t.Fail()
 		t.Logf("nodeList[0].Processed should be true")
 	}
 
-	if nodeList[1].Processed {
+	if tracker.nodeList[1].Processed {
 		t.Fail()
 		t.Logf("nodeList[1].Processed should be false")
 	}
@@ -89,17 +96,106 @@ func TestHasNodeBeenProcessed(t *testing.T) {
 10.0.0.2 10.0.0.2           49          97 0.24 d         m      node-2 
 10.0.0.3 10.0.0.3           18          93 0.39 d         m      node-3`
 
-	parseNodeList(nodeListResponse)
+	var tracker nodeTracker
+	tracker.parseNodeList(nodeListResponse)
 
-	setNodeAsProcessed("node-2")
+	tracker.setNodeAsProcessed("node-2")
 
-	if hasNodeBeenProcessed("node-1") {
+	if tracker.hasNodeBeenProcessed("node-1") {
 		t.Fail()
 		t.Logf("node-1 processed flag should be false")
 	}
 
-	if !hasNodeBeenProcessed("node-2") {
+	if !tracker.hasNodeBeenProcessed("node-2") {
 		t.Fail()
 		t.Logf("node-2 processed flag should be true")
 	}
 }
+
+func TestClusterGoingRedNotifiesWithinTheHour(t *testing.T) {
+	defer useTemporaryStateDirectory(t)()
+
+	configuration.NotifyOnClusterRed = true
+	configuration.NotifyOnClusterYellow = true
+	defer func() {
+		configuration.NotifyOnClusterRed = false
+		configuration.NotifyOnClusterYellow = false
+	}()
+
+	monitor := &clusterHealthMonitor{ClusterName: "prod"}
+	checkClusterHealth(clusterHealth{ClusterName: "prod", Status: "yellow"}, monitor, 0)
+	yellowNotified := monitor.LastClusterStateNotificationDate
+
+	time.Sleep(time.Millisecond)
+	checkClusterHealth(clusterHealth{ClusterName: "prod", Status: "red"}, monitor, 0)
+
+	if !monitor.LastClusterStateNotificationDate.After(yellowNotified) || monitor.ClusterStateAlert.Severity != severityCritical {
+		t.Fail()
+		t.Logf("A cluster going from yellow to red should be notified right away, was %+v", monitor.ClusterStateAlert)
+	}
+
+	redNotified := monitor.LastClusterStateNotificationDate
+	checkClusterHealth(clusterHealth{ClusterName: "prod", Status: "red"}, monitor, 0)
+
+	if !monitor.LastClusterStateNotificationDate.Equal(redNotified) {
+		t.Fail()
+		t.Logf("A cluster that stays red should only be notified once an hour")
+	}
+}
+
+func TestClusterHealthUnlockedWhileNotifying(t *testing.T) {
+	defer useTemporaryStateDirectory(t)()
+
+	notified := make(chan bool, 1)
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case notified <- true:
+		default:
+		}
+		<-release
+	}))
+	defer server.Close()
+
+	configuration.NotifyOnClusterRed = true
+	configuration.Notifications = []string{"webhook"}
+	configuration.DefaultWebhookURI = server.URL
+	configuration.DefaultWebhookMethod = "POST"
+	defer func() {
+		configuration.NotifyOnClusterRed = false
+		configuration.Notifications = nil
+		configuration.DefaultWebhookURI = ""
+		configuration.DefaultWebhookMethod = ""
+	}()
+
+	monitor := &clusterHealthMonitor{ClusterName: "prod"}
+	finished := make(chan bool)
+	go func() {
+		checkClusterHealth(clusterHealth{ClusterName: "prod", Status: "red"}, monitor, 0)
+		finished <- true
+	}()
+
+	select {
+	case <-notified:
+	case <-time.After(5 * time.Second):
+		t.Fail()
+		t.Logf("The notification was never sent")
+	}
+
+	locked := make(chan bool)
+	go func() {
+		monitor.Lock()
+		monitor.Unlock()
+		locked <- true
+	}()
+
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fail()
+		t.Logf("The cluster's monitor should not be locked while a notification is sent")
+	}
+
+	close(release)
+	<-finished
+}
@@ -3,12 +3,16 @@ package elastic
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/smtp"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/jordan-wright/email"
@@ -29,10 +33,15 @@ type searchQueryResult struct {
 }
 
 type hitHeader struct {
-	Total     int             `json:"took"`
+	Total     json.RawMessage `json:"total"`
 	Documents json.RawMessage `json:"hits"`
 }
 
+// Elasticsearch 7 and OpenSearch return the total as an object
+type hitTotal struct {
+	Value int `json:"value"`
+}
+
 type slackNotificationSetting struct {
 	URI     string `json:"uri"`
 	Channel string `json:"channel"`
@@ -41,8 +50,14 @@ type slackNotificationSetting struct {
 }
 
 type slackAttachment struct {
-	FallbackText string `json:"fallback"`
-	Text         string `json:"text"`
+	FallbackText string                 `json:"fallback"`
+	Text         string                 `json:"text"`
+	Color        string                 `json:"color,omitempty"`
+	Title        string                 `json:"title,omitempty"`
+	TitleLink    string                 `json:"title_link,omitempty"`
+	Fields       []slackAttachmentField `json:"fields,omitempty"`
+	Timestamp    int64                  `json:"ts,omitempty"`
+	MarkdownIn   []string               `json:"mrkdwn_in,omitempty"`
 }
 
 type slackMessage struct {
@@ -69,86 +84,240 @@ type hipChatNotificationSetting struct {
 }
 
 type notificationOverrides struct {
-	Slack   slackNotificationSetting   `json:"slack"`
-	Email   emailNotificationSetting   `json:"email"`
-	HipChat hipChatNotificationSetting `json:"hipchat"`
+	Slack     slackNotificationSetting     `json:"slack"`
+	Email     emailNotificationSetting     `json:"email"`
+	HipChat   hipChatNotificationSetting   `json:"hipchat"`
+	PagerDuty pagerDutyNotificationSetting `json:"pagerduty"`
+	Webhook   webhookNotificationSetting   `json:"webhook"`
+}
+
+// A notification for a rule or cluster check. Key stays the same for every
+// notification about the same rule or check so notifiers can group them.
+type alertNotification struct {
+	Key           string
+	Status        string
+	ClusterName   string
+	RuleName      string
+	QueryKey      string
+	QueryKeyValue string
+	Message       string
+	Value         float64
+	Threshold     float64
+	Operator      string
+	Timestamp     time.Time
+	FiringSince   time.Time
+	Attachment    []byte
+	Severity      string
+	KibanaURL     string
+	Template      *notificationTemplate
+	Overrides     notificationOverrides
 }
 
 type notificationRule struct {
-	Name                  string                `json:"rule_name"`
-	Type                  string                `json:"rule_type"`
-	NotificationMessage   string                `json:"notification_message"`
-	ClusterName           string                `json:"cluster_name"`
-	IndexName             string                `json:"index_name"`
-	DocumentType          string                `json:"document_type"`
-	Enabled               bool                  `json:"enabled"`
-	Operator              string                `json:"operator"`
-	Threshold             int                   `json:"threshold"`
-	Interval              int                   `json:"interval"`
-	NotificationInterval  int                   `json:"notification_interval"`
-	NotificationOverrides notificationOverrides `json:"notification_overrides"`
-	Query                 json.RawMessage       `json:"query"`
-	LastProcessedTime     time.Time
-	LastNotificationSent  time.Time
+	Name                   string                `json:"rule_name"`
+	Type                   string                `json:"rule_type"`
+	NotificationMessage    string                `json:"notification_message"`
+	ClusterName            string                `json:"cluster_name"`
+	IndexName              string                `json:"index_name"`
+	DocumentType           string                `json:"document_type"`
+	Enabled                bool                  `json:"enabled"`
+	Operator               string                `json:"operator"`
+	Severity               string                `json:"severity"`
+	Threshold              float64               `json:"threshold"`
+	Interval               int                   `json:"interval"`
+	NotificationInterval   int                   `json:"notification_interval"`
+	NotificationOverrides  notificationOverrides `json:"notification_overrides"`
+	Query                  json.RawMessage       `json:"query"`
+	Aggregation            json.RawMessage       `json:"aggregation"`
+	CardinalityField       string                `json:"cardinality_field"`
+	NumeratorQuery         json.RawMessage       `json:"numerator_query"`
+	DenominatorQuery       json.RawMessage       `json:"denominator_query"`
+	TimestampField         string                `json:"timestamp_field"`
+	SpikeTimeframe         int                   `json:"spike_timeframe"`
+	SpikeReference         string                `json:"spike_reference"`
+	SpikeComparison        string                `json:"spike_comparison"`
+	FlatlineDuration       int                   `json:"flatline_duration"`
+	QueryErrorThreshold    int                   `json:"query_error_threshold"`
+	QueryKey               string                `json:"query_key"`
+	QueryKeySize           int                   `json:"query_key_size"`
+	NewTermField           string                `json:"new_term_field"`
+	NewTermLookback        int                   `json:"new_term_lookback"`
+	NewTermSize            int                   `json:"new_term_size"`
+	KibanaURL              string                `json:"kibana_url"`
+	NotificationHits       int                   `json:"notification_hits"`
+	LastProcessedTime      time.Time
+	LastNotificationSent   time.Time
+	Alert                  alertState
+	BelowThresholdSince    time.Time
+	ConsecutiveQueryErrors int
+	LastQueryError         string
+	QueryErrorAlert        alertState
+	QueryKeyAlerts         map[string]*queryKeyAlert
+	KnownTerms             *knownTerms
 }
 
 var reloadNotifications bool
 var notificationRules []notificationRule
 
+// Guards notificationRules while rules run, so the status api reads a consistent copy
+var notificationRulesLock sync.RWMutex
+
 func readNotificationRules() []notificationRule {
 	var readRules []notificationRule
-	if _, err := os.Stat("rules"); err != nil {
-		if os.IsNotExist(err) {
-			// folder does not exist. Since no rules are expected to run, log and continue
-			log.Print("rules folder does not exist. No rules are loaded.")
-			return readRules
-		}
 
-		// if the error is something else, like possibly permissions, log the error and kill the process
+	paths, err := ruleFiles()
+	if err != nil {
+		// if the error is something like permissions, log the error and kill the process
 		log.Fatal("Error loading rules folder ", err)
+	}
+
+	for _, path := range paths {
+		log.Print("Loading notification rule from ", path)
+
+		rule, err := readRuleFile(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		readRules = append(readRules, rule)
+	}
+
+	return readRules
+}
+
+// Returns the path of every file in the rules folders
+func ruleFiles() ([]string, error) {
+	var paths []string
+
+	for _, folder := range startupOptions.RulesFolders {
+		if _, err := os.Stat(folder); os.IsNotExist(err) {
+			// folder does not exist. Since no rules are expected to run from it, log and continue
+			log.Printf("rules folder %v does not exist. No rules are loaded from it.", folder)
+			continue
+		}
+
+		files, err := ioutil.ReadDir(folder)
+		if err != nil {
+			return nil, err
+		}
 
+		for _, file := range files {
+			paths = append(paths, filepath.Join(folder, file.Name()))
+		}
 	}
 
-	files, err := ioutil.ReadDir("rules")
+	return paths, nil
+}
+
+// Reads a rule file, fills in the rule's defaults and checks it
+func readRuleFile(path string) (notificationRule, error) {
+	var rule notificationRule
+
+	fileJSON, err := ioutil.ReadFile(path)
 	if err != nil {
-		log.Fatal("Error loading rules folder ", err)
+		return rule, fmt.Errorf("error reading rule file %v: %v", path, err)
 	}
 
-	for _, file := range files {
-		log.Print("Loading notification rule from ", file.Name())
+	err = json.Unmarshal(fileJSON, &rule)
+	if err != nil {
+		return rule, fmt.Errorf("error parsing rule file %v: %v", path, err)
+	}
 
-		fileJSON, err := ioutil.ReadFile("rules/" + file.Name())
-		if err != nil {
-			log.Fatal("Error reading rule file: ", file.Name(), err)
+	err = prepareNotificationRule(&rule)
+	if err != nil {
+		return rule, fmt.Errorf("rule file %v is not valid: %v", path, err)
+	}
+
+	return rule, nil
+}
+
+func prepareNotificationRule(rule *notificationRule) error {
+	hasClusterConfig := false
+	for _, cluster := range configuration.ElasticClientsFrom {
+		if cluster.ClusterName == rule.ClusterName {
+			hasClusterConfig = true
 		}
+	}
 
-		var rule notificationRule
+	if !hasClusterConfig && rule.Enabled {
+		return fmt.Errorf("rule is enabled but no cluster configuration could be found for %v", rule.ClusterName)
+	}
 
-		err = json.Unmarshal(fileJSON, &rule)
+	if !validRuleType(rule.Type) {
+		return fmt.Errorf("unknown rule_type %q, should be one of %v", rule.Type, strings.Join(ruleTypes, ", "))
+	}
+
+	if rule.Type == "metric" && len(rule.Aggregation) == 0 {
+		return errors.New("metric rule has no aggregation")
+	}
+
+	if rule.Type == "cardinality" {
+		if rule.CardinalityField == "" {
+			return errors.New("cardinality rule has no cardinality_field")
+		}
+		rule.Aggregation = buildCardinalityAggregation(rule.CardinalityField)
+	}
+
+	if rule.Severity == "" {
+		rule.Severity = defaultRuleSeverity
+	}
+
+	if !validSeverity(rule.Severity) {
+		return fmt.Errorf("unknown severity %v", rule.Severity)
+	}
+
+	if rule.Type == "flatline" && rule.Operator == "" {
+		rule.Operator = "<"
+	}
+
+	// New term rules alert on every new value, so don't compare with a threshold
+	if rule.Type != "new_term" && !validOperator(rule.Operator) {
+		return fmt.Errorf("unknown operator %q", rule.Operator)
+	}
+
+	if rule.QueryKey != "" && rule.Type != "count" && !usesAggregation(rule) {
+		return errors.New("query_key can only be used with count, metric and cardinality rules")
+	}
+
+	if isMessageTemplate(rule.NotificationMessage) {
+		err := parseMessageTemplate(rule.NotificationMessage)
 		if err != nil {
-			log.Fatalf("Error parsing rule file: %v %v", file.Name(), err)
+			return fmt.Errorf("notification_message is not a valid template: %v", err)
 		}
+	}
 
-		hasClusterConfig := false
-		for _, cluster := range configuration.ElasticClientsFrom {
-			if cluster.ClusterName == rule.ClusterName {
-				hasClusterConfig = true
-			}
+	if rule.Type == "new_term" {
+		err := validateNewTermRule(*rule)
+		if err != nil {
+			return fmt.Errorf("new term rule is not valid: %v", err)
 		}
+	}
 
-		if !hasClusterConfig && rule.Enabled {
-			log.Fatal("Rules ensabled but no cluster configuration could be found for: ", rule.ClusterName)
+	if rule.Type == "ratio" {
+		err := validateRatioRule(*rule)
+		if err != nil {
+			return fmt.Errorf("ratio rule is not valid: %v", err)
 		}
+	}
 
-		readRules = append(readRules, rule)
+	if rule.Type == "spike" {
+		err := validateSpikeRule(*rule)
+		if err != nil {
+			return fmt.Errorf("spike rule is not valid: %v", err)
+		}
 	}
 
-	return readRules
+	return nil
 }
 
 func loadNotificationRules() {
+	notificationRulesLock.Lock()
+	defer notificationRulesLock.Unlock()
 
 	notificationRules = readNotificationRules()
+	for i := range notificationRules {
+		restoreRuleState(&notificationRules[i])
+	}
 
 	reloadNotifications = false
 }
@@ -162,6 +331,13 @@ func reloadNotificationRules() {
 			if reloadedRules[i].Name == notificationRules[j].Name {
 				reloadedRules[i].LastNotificationSent = notificationRules[j].LastNotificationSent
 				reloadedRules[i].LastProcessedTime = notificationRules[j].LastProcessedTime
+				reloadedRules[i].Alert = notificationRules[j].Alert
+				reloadedRules[i].BelowThresholdSince = notificationRules[j].BelowThresholdSince
+				reloadedRules[i].ConsecutiveQueryErrors = notificationRules[j].ConsecutiveQueryErrors
+				reloadedRules[i].LastQueryError = notificationRules[j].LastQueryError
+				reloadedRules[i].QueryErrorAlert = notificationRules[j].QueryErrorAlert
+				reloadedRules[i].QueryKeyAlerts = notificationRules[j].QueryKeyAlerts
+				reloadedRules[i].KnownTerms = notificationRules[j].KnownTerms
 			}
 		}
 	}
@@ -171,108 +347,230 @@ func reloadNotificationRules() {
 	reloadNotifications = false
 }
 
+// Rules run on a copy of notificationRules, so the lock is only held while
+// the copy is taken and each rule's state is written back, not while the
+// rule queries its cluster and sends notifications. Only this function
+// replaces notificationRules once monitoring has started, so a rule keeps
+// its index while it runs.
 func runNotificationRules() {
+	notificationRulesLock.Lock()
 	if reloadNotifications {
 		reloadNotificationRules()
 	}
 
-	for i := 0; i < len(notificationRules); i++ {
+	rules := make([]notificationRule, len(notificationRules))
+	for i := range notificationRules {
+		rules[i] = notificationRules[i].copyForRun()
+	}
+	notificationRulesLock.Unlock()
+
+	for i := 0; i < len(rules); i++ {
 		// determine if the rule should be run.
-		if notificationRules[i].Enabled {
-			if notificationRules[i].LastProcessedTime.Before(time.Now().
-				Add(time.Minute * time.Duration(notificationRules[i].Interval) * -1)) {
+		if rules[i].Enabled {
+			if rules[i].LastProcessedTime.Before(time.Now().
+				Add(time.Minute * time.Duration(rules[i].Interval) * -1)) {
+
+				log.Print("Running rule: ", rules[i].Name)
+				rules[i].LastProcessedTime = time.Now().Add(time.Second * -1)
 
-				log.Print("Running rule: ", notificationRules[i].Name)
-				notificationRules[i].LastProcessedTime = time.Now().Add(time.Second * -1)
+				processNotificationRule(&rules[i])
 
-				processNotificationRule(&notificationRules[i])
+				notificationRulesLock.Lock()
+				notificationRules[i] = rules[i]
+				notificationRulesLock.Unlock()
+
+				saveRuleState(&rules[i])
 			}
 		}
 	}
 }
 
-func processNotificationRule(rule *notificationRule) {
+// Returns a copy of the rule that can be run while the status api reads the
+// original. The query_key alerts are copied too, since running changes them.
+func (rule notificationRule) copyForRun() notificationRule {
+	if rule.QueryKeyAlerts != nil {
+		queryKeyAlerts := make(map[string]*queryKeyAlert, len(rule.QueryKeyAlerts))
+		for value, state := range rule.QueryKeyAlerts {
+			copied := *state
+			queryKeyAlerts[value] = &copied
+		}
+		rule.QueryKeyAlerts = queryKeyAlerts
+	}
+	return rule
+}
+
+// Returns the hosts of the cluster in elastic_clients_from
+func clusterHosts(clusterName string) []string {
 	var hosts []string
 
 	for _, cluster := range configuration.ElasticClientsFrom {
-		if cluster.ClusterName == rule.ClusterName {
+		if cluster.ClusterName == clusterName {
 			hosts = cluster.Hosts
 		}
 	}
 
-	var urlBuffer bytes.Buffer
-	if rule.IndexName == "" {
-		urlBuffer.WriteString("*")
-	} else {
-		urlBuffer.WriteString(rule.IndexName)
-		if rule.DocumentType != "" {
-			urlBuffer.WriteString("/")
-			urlBuffer.WriteString(rule.DocumentType)
+	return hosts
+}
+
+func processNotificationRule(rule *notificationRule) {
+	hosts := clusterHosts(rule.ClusterName)
+	version := versionForRuleCluster(rule.ClusterName)
+
+	if rule.Type == "new_term" {
+		err := processNewTermRule(rule, hosts, version)
+		if err != nil {
+			log.Printf("Error running query for rule %v : %v", rule.Name, err)
+			recordQueryError(rule, err)
+			return
 		}
-	}
-	if rule.Type == "count" {
-		urlBuffer.WriteString("/_count")
+
+		recordQuerySuccess(rule)
+		return
 	}
 
-	if rule.Type == "search" {
-		urlBuffer.WriteString("/_search")
+	if rule.QueryKey != "" {
+		results, err := evaluateGroupedRule(rule, hosts, version)
+		if err != nil {
+			log.Printf("Error running query for rule %v : %v", rule.Name, err)
+			recordQueryError(rule, err)
+			return
+		}
+
+		recordQuerySuccess(rule)
+		processGroupedResults(rule, results, time.Now())
+		return
 	}
 
-	body, err := failoverHTTPRequest(hosts, "POST", urlBuffer.String(), bytes.NewBuffer([]byte(string(rule.Query))))
+	result, err := evaluateRule(rule, hosts, version)
 	if err != nil {
 		log.Printf("Error running query for rule %v : %v", rule.Name, err)
-	} else {
-		var hitCount int
-		var queryResults []byte
-		var parseErr error
+		recordQueryError(rule, err)
+		return
+	}
 
-		if rule.Type == "count" {
-			hitCount, parseErr = parseCountQuery(body)
-		}
+	recordQuerySuccess(rule)
 
-		if rule.Type == "search" {
-			hitCount, queryResults, parseErr = parseSearchQuery(body)
-		}
+	notify := !result.NoValue && evaluateOperator(rule.Operator, result.Value, rule.Threshold)
+
+	if rule.Type == "flatline" {
+		notify = rule.checkFlatline(notify, time.Now())
+		result.Description = flatlineDescription(rule, result, time.Now())
+	}
 
-		if parseErr != nil {
-			log.Printf("Error parsing result of query for rule %v : %v", rule.Name, parseErr)
+	notifyRuleResult(rule, result, notify, &rule.LastNotificationSent, &rule.Alert)
+}
+
+// Sends a notification if the rule's condition was met, or a resolved
+// notification if it was firing and no longer is. lastSent and alert are
+// the rule's own, or those of one query_key value.
+func notifyRuleResult(rule *notificationRule, result ruleResult, notify bool, lastSent *time.Time, alert *alertState) {
+	alertKey := ruleAlertKey(rule.Name)
+	if result.QueryKeyValue != "" {
+		alertKey = ruleQueryKeyAlertKey(rule.Name, result.QueryKeyValue)
+	}
+	description := describeRuleResult(rule, result)
+
+	if !notify {
+		if duration, resolved := alert.resolve(time.Now()); resolved {
+			message, messageTemplate := buildRuleMessage(rule, result, alertStateResolved,
+				fmt.Sprintf("Resolved: %v %v after %v", rule.NotificationMessage, description, formatIncidentDuration(duration)),
+				"Resolved: %v after "+formatIncidentDuration(duration))
+
+			sendNotification(alertNotification{
+				Key:           alertKey,
+				Status:        alertStateResolved,
+				ClusterName:   rule.ClusterName,
+				RuleName:      rule.Name,
+				QueryKey:      rule.QueryKey,
+				QueryKeyValue: result.QueryKeyValue,
+				Message:       message,
+				Template:      messageTemplate,
+				Severity:      rule.Severity,
+				KibanaURL:     ruleKibanaURL(rule),
+				Value:         result.Value,
+				Threshold:     rule.Threshold,
+				Operator:      rule.Operator,
+				Timestamp:     time.Now(),
+				FiringSince:   alert.FiringSince,
+				Overrides:     rule.NotificationOverrides,
+			})
 			return
 		}
 
-		notify := false
-
-		switch rule.Operator {
-		case "eq", "==":
-			notify = hitCount == rule.Threshold
-			break
-		case "neq", "!=", "<>":
-			notify = hitCount != rule.Threshold
-			break
-		case "gt", ">":
-			notify = hitCount > rule.Threshold
-			break
-		case "gte", ">=":
-			notify = hitCount >= rule.Threshold
-			break
-		case "lt", "<":
-			notify = hitCount < rule.Threshold
-			break
-		case "lte", "<=":
-			notify = hitCount <= rule.Threshold
-			break
-		}
+		recordAlertHistory(ruleEvaluationHistory(rule, result, historyStatusOK))
+		return
+	}
 
-		if rule.LastNotificationSent.After(time.Now().Add(time.Hour * time.Duration(rule.NotificationInterval) * -1)) {
-			notify = false
-		}
+	if lastSent.After(time.Now().Add(time.Hour * time.Duration(rule.NotificationInterval) * -1)) {
+		recordAlertHistory(ruleEvaluationHistory(rule, result, historyStatusThrottled))
+		notify = false
+	}
+
+	if notify {
+		*lastSent = time.Now()
+		alert.fire(time.Now())
+
+		message, messageTemplate := buildRuleMessage(rule, result, alertStateFiring,
+			fmt.Sprintf("%v %v", rule.NotificationMessage, description), "%v")
+
+		sendNotification(alertNotification{
+			Key:           alertKey,
+			Status:        alertStateFiring,
+			ClusterName:   rule.ClusterName,
+			RuleName:      rule.Name,
+			QueryKey:      rule.QueryKey,
+			QueryKeyValue: result.QueryKeyValue,
+			Message:       message,
+			Template:      messageTemplate,
+			Severity:      rule.Severity,
+			KibanaURL:     ruleKibanaURL(rule),
+			Value:         result.Value,
+			Threshold:     rule.Threshold,
+			Operator:      rule.Operator,
+			Timestamp:     time.Now(),
+			FiringSince:   alert.FiringSince,
+			Attachment:    result.Attachment,
+			Overrides:     rule.NotificationOverrides,
+		})
+	}
+}
 
-		if notify {
-			rule.LastNotificationSent = time.Now()
+// Describes the result for a notification, with the query_key value if it has one
+func describeRuleResult(rule *notificationRule, result ruleResult) string {
+	if result.QueryKeyValue != "" {
+		return fmt.Sprintf("(%v: %v) %v", rule.QueryKey, result.QueryKeyValue, result.Description)
+	}
+	return result.Description
+}
 
-			sendNotification(fmt.Sprintf("%v Result count was %v", rule.NotificationMessage, hitCount),
-				queryResults, rule.NotificationOverrides)
+// Builds the path for the rule's query. The document type is only used on
+// clusters that still have mapping types.
+func buildRuleURL(rule *notificationRule, version clusterVersion) string {
+	var urlBuffer bytes.Buffer
+	if rule.IndexName == "" {
+		urlBuffer.WriteString("*")
+	} else {
+		urlBuffer.WriteString(rule.IndexName)
+		if rule.DocumentType != "" && !version.typeless() {
+			urlBuffer.WriteString("/")
+			urlBuffer.WriteString(rule.DocumentType)
 		}
 	}
+	// Grouped rules need a terms aggregation, so are always searches
+	if rule.QueryKey != "" {
+		urlBuffer.WriteString("/_search")
+		return urlBuffer.String()
+	}
+
+	if rule.Type == "count" || rule.Type == "spike" || rule.Type == "flatline" || rule.Type == "ratio" {
+		urlBuffer.WriteString("/_count")
+	}
+
+	if rule.Type == "search" || usesAggregation(rule) || rule.Type == "new_term" {
+		urlBuffer.WriteString("/_search")
+	}
+
+	return urlBuffer.String()
 }
 
 func parseCountQuery(result []byte) (int, error) {
@@ -291,7 +589,31 @@ func parseSearchQuery(result []byte) (int, []byte, error) {
 		return -1, nil, err
 	}
 
-	return queryResult.Took, []byte(queryResult.HitHeader.Documents), nil
+	total, err := parseHitTotal(queryResult.HitHeader.Total)
+	if err != nil {
+		return -1, nil, err
+	}
+
+	return total, []byte(queryResult.HitHeader.Documents), nil
+}
+
+// Reads hits.total whether it is a number or an object with a value
+func parseHitTotal(rawTotal json.RawMessage) (int, error) {
+	if len(rawTotal) == 0 {
+		return 0, nil
+	}
+
+	var total int
+	if err := json.Unmarshal(rawTotal, &total); err == nil {
+		return total, nil
+	}
+
+	var totalObject hitTotal
+	err := json.Unmarshal(rawTotal, &totalObject)
+	if err != nil {
+		return -1, err
+	}
+	return totalObject.Value, nil
 }
 
 func buildSlackSettings(overrideSettings slackNotificationSetting) slackNotificationSetting {
@@ -377,44 +699,101 @@ func buildHipChatSettings(overrideSettings hipChatNotificationSetting) hipChatNo
 	return hipChatSettings
 }
 
-func sendNotification(message string, attachment []byte, overrides notificationOverrides) {
+func ruleAlertKey(ruleName string) string {
+	return "gwylio/rule/" + ruleName
+}
+
+func ruleQueryErrorAlertKey(ruleName string) string {
+	return ruleAlertKey(ruleName) + "/query_error"
+}
+
+func ruleQueryKeyAlertKey(ruleName string, queryKeyValue string) string {
+	return ruleAlertKey(ruleName) + "/key/" + queryKeyValue
+}
 
-	for _, notifyMethod := range configuration.Notifications {
-		if notifyMethod == "slack" {
-			slackSettings := buildSlackSettings(overrides.Slack)
-			sendSlackNotification(slackSettings, message)
+func clusterAlertKey(clusterName string, check string) string {
+	return "gwylio/cluster/" + clusterName + "/" + check
+}
+
+func sendNotification(alert alertNotification) {
+	// Resolved notifications are optional for chat and email, but PagerDuty
+	// always needs them so the incident it opened gets closed
+	notifyResolved := alert.Status != alertStateResolved || configuration.NotifyOnResolved
+
+	history := alertHistoryFor(alert, historyStatusFired)
+	if alert.Status == alertStateResolved {
+		history.Status = historyStatusResolved
+	}
+	defer func() { recordAlertHistory(history) }()
+
+	// A silenced alert's state is still tracked, only the notifiers are
+	// skipped. PagerDuty still gets resolves so incidents opened before the
+	// silence get closed.
+	if matched, silenced := activeSilence(alert, time.Now()); silenced {
+		recordSuppressed(matched)
+		log.Printf("Notification suppressed by silence %v: %v", matched.ID, alert.Message)
+
+		history.Status = historyStatusSuppressed
+		history.SilenceID = matched.ID
+
+		if alert.Status != alertStateResolved {
+			return
 		}
+		notifyResolved = false
+	}
 
-		if notifyMethod == "email" {
-			emailSettings := buildEmailSettings(overrides.Email)
-			sendEmailNotification(emailSettings, message, attachment)
+	for _, notifyMethod := range notifiersFor(alert.Severity) {
+		if !notifyResolved && notifyMethod != "pagerduty" {
+			continue
 		}
 
-		if notifyMethod == "hipchat" {
-			hipchatSettings := buildHipChatSettings(overrides.HipChat)
-			sendHipChatNotification(hipchatSettings, message)
+		sent := time.Now()
+		var err error
+
+		switch notifyMethod {
+		case "slack":
+			slackSettings := buildSlackSettings(alert.Overrides.Slack)
+			err = sendSlackNotification(slackSettings, alert)
+		case "email":
+			emailSettings := buildEmailSettings(alert.Overrides.Email)
+			err = sendEmailNotification(emailSettings, alert.Message, alert.Attachment)
+		case "hipchat":
+			hipchatSettings := buildHipChatSettings(alert.Overrides.HipChat)
+			err = sendHipChatNotification(hipchatSettings, alert.Message)
+		case "pagerduty":
+			pagerDutySettings := buildPagerDutySettings(alert.Overrides.PagerDuty)
+			err = sendPagerDutyNotification(pagerDutySettings, alert)
+		case "webhook":
+			webhookSettings := buildWebhookSettings(alert.Overrides.Webhook)
+			err = sendWebhookNotification(webhookSettings, alert)
+		default:
+			continue
 		}
+
+		if err != nil {
+			log.Printf("Error sending %v notification: %v", notifyMethod, err)
+		}
+		history.addDelivery(notifyMethod, err, time.Since(sent))
 	}
 
-	log.Print("Notification Posted: ", message)
+	log.Print("Notification Posted: ", alert.Message)
 }
 
-func sendSlackNotification(settings slackNotificationSetting, message string) {
+func sendSlackNotification(settings slackNotificationSetting, alert alertNotification) error {
 	var slackNotificationMessage slackMessage
-	slackNotificationMessage.Message = message
+	slackNotificationMessage.Message = alert.messageFor(messageFormatSlack)
+	slackNotificationMessage.Attachments = []slackAttachment{buildSlackAttachment(alert)}
 	slackNotificationMessage.Sender = settings.Sender
 	slackNotificationMessage.Channel = settings.Channel
 	slackNotificationMessage.Emoji = settings.Emoji
 
 	if settings.URI == "" {
-		log.Print("Slack URI not valid")
-		return
+		return errors.New("Slack URI not valid")
 	}
 
 	uri, err := url.Parse(settings.URI)
 	if err != nil {
-		log.Print("Slack URI not valid")
-		return
+		return errors.New("Slack URI not valid")
 	}
 
 	messageBody, _ := json.Marshal(slackNotificationMessage)
@@ -425,14 +804,13 @@ func sendSlackNotification(settings slackNotificationSetting, message string) {
 
 	hosts := []string{hostURI}
 
-	failoverHTTPRequest(hosts, "POST", uri.Path, bytes.NewBuffer(messageBody))
-
+	_, err = failoverHTTPRequest(hosts, "POST", uri.Path, bytes.NewBuffer(messageBody))
+	return err
 }
 
-func sendEmailNotification(settings emailNotificationSetting, message string, attachment []byte) {
+func sendEmailNotification(settings emailNotificationSetting, message string, attachment []byte) error {
 	if settings.SMTPServer == "" || settings.FromAddress == "" || len(settings.ToAddresses) == 0 {
-		log.Print("Email settings are not valid")
-		return
+		return errors.New("email settings are not valid")
 	}
 
 	msg := email.NewEmail()
@@ -449,23 +827,17 @@ func sendEmailNotification(settings emailNotificationSetting, message string, at
 		auth = smtp.PlainAuth("", settings.SMTPAuthUser, settings.SMTPAuthPassword, settings.SMTPServer)
 	}
 
-	err := msg.Send(fmt.Sprintf("%v:%v", settings.SMTPServer, settings.SMTPPort), auth)
-	if err != nil {
-		log.Print("Error sending email notification: ", err)
-	}
-
+	return msg.Send(fmt.Sprintf("%v:%v", settings.SMTPServer, settings.SMTPPort), auth)
 }
 
-func sendHipChatNotification(settings hipChatNotificationSetting, message string) {
+func sendHipChatNotification(settings hipChatNotificationSetting, message string) error {
 
 	if settings.AuthToken == "" {
-		log.Print("HipChat Auth Token not set")
-		return
+		return errors.New("HipChat Auth Token not set")
 	}
 
 	if settings.Room == "" {
-		log.Print("HipChat Room not set")
-		return
+		return errors.New("HipChat Room not set")
 	}
 
 	c := hipchat.NewClient(settings.AuthToken)
@@ -476,5 +848,6 @@ func sendHipChatNotification(settings hipChatNotificationSetting, message string
 	}
 
 	notifRq := &hipchat.NotificationRequest{Message: message}
-	c.Room.Notification(settings.Room, notifRq)
+	_, err := c.Room.Notification(settings.Room, notifRq)
+	return err
 }
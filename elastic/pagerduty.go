@@ -0,0 +1,123 @@
+package elastic
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const defaultPagerDutyEventsURI = "https://events.pagerduty.com/v2/enqueue"
+
+// PagerDuty rejects summaries with more characters than this
+const pagerDutyMaxSummaryLength = 1024
+
+type pagerDutyNotificationSetting struct {
+	RoutingKey string `json:"routing_key"`
+}
+
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary   string `json:"summary"`
+	Source    string `json:"source"`
+	Severity  string `json:"severity"`
+	Component string `json:"component,omitempty"`
+}
+
+func buildPagerDutySettings(overrideSettings pagerDutyNotificationSetting) pagerDutyNotificationSetting {
+	var pagerDutySettings pagerDutyNotificationSetting
+	pagerDutySettings.RoutingKey = configuration.DefaultPagerDutyRoutingKey
+
+	if overrideSettings.RoutingKey != "" {
+		pagerDutySettings.RoutingKey = overrideSettings.RoutingKey
+	}
+
+	return pagerDutySettings
+}
+
+// Builds a trigger event for a firing alert or a resolve event for a resolved one.
+// The alert key is used as the dedup key so repeat triggers update the same incident.
+func buildPagerDutyEvent(settings pagerDutyNotificationSetting, alert alertNotification) pagerDutyEvent {
+	event := pagerDutyEvent{
+		RoutingKey:  settings.RoutingKey,
+		EventAction: "trigger",
+		DedupKey:    alert.Key,
+	}
+
+	if alert.Status == alertStateResolved {
+		event.EventAction = "resolve"
+		return event
+	}
+
+	// Cut by characters, a cut in the middle of one isn't valid UTF-8
+	summary := alert.Message
+	if runes := []rune(summary); len(runes) > pagerDutyMaxSummaryLength {
+		summary = string(runes[:pagerDutyMaxSummaryLength])
+	}
+
+	source := alert.ClusterName
+	if source == "" {
+		source = "gwylio"
+	}
+
+	event.Payload = &pagerDutyPayload{
+		Summary:   summary,
+		Source:    source,
+		Severity:  pagerDutySeverity(alert.Severity),
+		Component: alert.RuleName,
+	}
+
+	return event
+}
+
+// PagerDuty has the same critical, warning and info severities. Alerts
+// without one are critical.
+func pagerDutySeverity(severity string) string {
+	if severity == "" {
+		return severityCritical
+	}
+	return severity
+}
+
+func sendPagerDutyNotification(settings pagerDutyNotificationSetting, alert alertNotification) error {
+	if settings.RoutingKey == "" {
+		return errors.New("PagerDuty routing key not set")
+	}
+
+	eventsURI := defaultPagerDutyEventsURI
+	if configuration.PagerDutyEventsURI != "" {
+		eventsURI = configuration.PagerDutyEventsURI
+	}
+
+	_, err := url.ParseRequestURI(eventsURI)
+	if err != nil {
+		return errors.New("PagerDuty events URI not valid")
+	}
+
+	eventBody, _ := json.Marshal(buildPagerDutyEvent(settings, alert))
+
+	client := http.Client{
+		Timeout: time.Duration(10 * time.Second),
+	}
+
+	resp, err := client.Post(eventsURI, "application/json", bytes.NewBuffer(eventBody))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("PagerDuty returned status %v", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package elastic
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestPagerDutySettingsDefaults(t *testing.T) {
+	routingKey := "R0UT1NGK3Y"
+	configuration.DefaultPagerDutyRoutingKey = routingKey
+
+	var pagerDutyOverrides pagerDutyNotificationSetting
+
+	overriddenSettings := buildPagerDutySettings(pagerDutyOverrides)
+
+	if overriddenSettings.RoutingKey != routingKey {
+		t.Fail()
+		t.Logf("PagerDuty routing key shouldn't be overridden if it was blank")
+	}
+}
+
+func TestPagerDutySettingsOverrides(t *testing.T) {
+	configuration.DefaultPagerDutyRoutingKey = "R0UT1NGK3Y"
+	overriddenRoutingKey := "0VERR1DDEN"
+
+	var pagerDutyOverrides pagerDutyNotificationSetting
+	pagerDutyOverrides.RoutingKey = overriddenRoutingKey
+
+	overriddenSettings := buildPagerDutySettings(pagerDutyOverrides)
+
+	if overriddenSettings.RoutingKey != overriddenRoutingKey {
+		t.Fail()
+		t.Logf("PagerDuty routing key should be overridden")
+	}
+}
+
+func TestPagerDutyTriggerAndResolveShareDedupKey(t *testing.T) {
+	settings := pagerDutyNotificationSetting{RoutingKey: "R0UT1NGK3Y"}
+
+	trigger := buildPagerDutyEvent(settings, alertNotification{
+		Key:         clusterAlertKey("my-cluster", "cluster_state"),
+		Status:      alertStateFiring,
+		ClusterName: "my-cluster",
+		Message:     "Cluster state is red for my-cluster",
+	})
+
+	resolve := buildPagerDutyEvent(settings, alertNotification{
+		Key:         clusterAlertKey("my-cluster", "cluster_state"),
+		Status:      alertStateResolved,
+		ClusterName: "my-cluster",
+		Message:     "Resolved: Cluster state is green for my-cluster after 5m0s",
+	})
+
+	if trigger.EventAction != "trigger" {
+		t.Fail()
+		t.Logf("Firing alert should send a trigger event, was %v", trigger.EventAction)
+	}
+
+	if trigger.Payload == nil || trigger.Payload.Source != "my-cluster" {
+		t.Fail()
+		t.Logf("Trigger event should have a payload with the cluster as the source")
+	}
+
+	if resolve.EventAction != "resolve" {
+		t.Fail()
+		t.Logf("Resolved alert should send a resolve event, was %v", resolve.EventAction)
+	}
+
+	if trigger.DedupKey != resolve.DedupKey {
+		t.Fail()
+		t.Logf("Trigger and resolve events should have the same dedup key. Was %v and %v",
+			trigger.DedupKey, resolve.DedupKey)
+	}
+}
+
+func TestPagerDutySummaryCutAtCharacter(t *testing.T) {
+	// Cutting at 1024 bytes would split the first é in half
+	message := strings.Repeat("a", pagerDutyMaxSummaryLength-1) + "éé"
+
+	event := buildPagerDutyEvent(pagerDutyNotificationSetting{}, alertNotification{
+		Status:  alertStateFiring,
+		Message: message,
+	})
+
+	summary := event.Payload.Summary
+	if !utf8.ValidString(summary) || utf8.RuneCountInString(summary) != pagerDutyMaxSummaryLength ||
+		!strings.HasSuffix(summary, "aé") {
+
+		t.Fail()
+		t.Logf("Summary should be cut to %v whole characters, ended with %q", pagerDutyMaxSummaryLength,
+			summary[len(summary)-4:])
+	}
+}
+
+func TestSendPagerDutyNotification(t *testing.T) {
+	var receivedPath, receivedContentType string
+	var receivedEvent pagerDutyEvent
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestBody, _ := ioutil.ReadAll(r.Body)
+		receivedPath = r.URL.Path
+		receivedContentType = r.Header.Get("Content-Type")
+		json.Unmarshal(requestBody, &receivedEvent)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer testServer.Close()
+
+	configuration.PagerDutyEventsURI = testServer.URL + "/v2/enqueue"
+	defer func() { configuration.PagerDutyEventsURI = "" }()
+
+	err := sendPagerDutyNotification(pagerDutyNotificationSetting{RoutingKey: "R0UT1NGK3Y"}, alertNotification{
+		Key:         clusterAlertKey("my-cluster", "cluster_state"),
+		Status:      alertStateFiring,
+		ClusterName: "my-cluster",
+		Message:     "Cluster state is red for my-cluster",
+		Severity:    severityCritical,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if receivedPath != "/v2/enqueue" {
+		t.Fail()
+		t.Logf("Event should be sent to /v2/enqueue, was %v", receivedPath)
+	}
+
+	if receivedContentType != "application/json" {
+		t.Fail()
+		t.Logf("Event should be sent as json, was %v", receivedContentType)
+	}
+
+	if receivedEvent.RoutingKey != "R0UT1NGK3Y" || receivedEvent.EventAction != "trigger" ||
+		receivedEvent.DedupKey != clusterAlertKey("my-cluster", "cluster_state") ||
+		receivedEvent.Payload == nil || receivedEvent.Payload.Summary != "Cluster state is red for my-cluster" {
+
+		t.Fail()
+		t.Logf("Event payload is incorrect, was %+v", receivedEvent)
+	}
+}
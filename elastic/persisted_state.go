@@ -0,0 +1,124 @@
+package elastic
+
+import (
+	"log"
+	"time"
+)
+
+// Folders in the state directory rule and cluster alert state is saved in
+const (
+	ruleStateFolder    = "rules"
+	clusterStateFolder = "clusters"
+)
+
+// The parts of a rule's state that are saved, so a restart doesn't run
+// every rule straight away or resend notifications for open alerts
+type savedRuleState struct {
+	LastProcessedTime      time.Time
+	LastNotificationSent   time.Time
+	Alert                  alertState
+	BelowThresholdSince    time.Time
+	ConsecutiveQueryErrors int
+	LastQueryError         string
+	QueryErrorAlert        alertState
+	QueryKeyAlerts         map[string]*queryKeyAlert
+}
+
+// The parts of a cluster's health tracking that are saved. The node count
+// and cluster state aren't, they are read again on the first collection.
+type savedClusterState struct {
+	LastGoodNodeCountDate            time.Time
+	LastGoodClusterStatusDate        time.Time
+	LastNodeCountNotificationTime    time.Time
+	LastClusterStateNotificationDate time.Time
+	NodeCountAlert                   alertState
+	ClusterStateAlert                alertState
+}
+
+func (rule *notificationRule) savedState() savedRuleState {
+	return savedRuleState{
+		LastProcessedTime:      rule.LastProcessedTime,
+		LastNotificationSent:   rule.LastNotificationSent,
+		Alert:                  rule.Alert,
+		BelowThresholdSince:    rule.BelowThresholdSince,
+		ConsecutiveQueryErrors: rule.ConsecutiveQueryErrors,
+		LastQueryError:         rule.LastQueryError,
+		QueryErrorAlert:        rule.QueryErrorAlert,
+		QueryKeyAlerts:         rule.QueryKeyAlerts,
+	}
+}
+
+func (rule *notificationRule) restoreState(state savedRuleState) {
+	rule.LastProcessedTime = state.LastProcessedTime
+	rule.LastNotificationSent = state.LastNotificationSent
+	rule.Alert = state.Alert
+	rule.BelowThresholdSince = state.BelowThresholdSince
+	rule.ConsecutiveQueryErrors = state.ConsecutiveQueryErrors
+	rule.LastQueryError = state.LastQueryError
+	rule.QueryErrorAlert = state.QueryErrorAlert
+	rule.QueryKeyAlerts = state.QueryKeyAlerts
+}
+
+// Must be called with the monitor locked
+func (clusterMonitor *clusterHealthMonitor) savedState() savedClusterState {
+	return savedClusterState{
+		LastGoodNodeCountDate:            clusterMonitor.LastGoodNodeCountDate,
+		LastGoodClusterStatusDate:        clusterMonitor.LastGoodClusterStatusDate,
+		LastNodeCountNotificationTime:    clusterMonitor.LastNodeCountNotificationTime,
+		LastClusterStateNotificationDate: clusterMonitor.LastClusterStateNotificationDate,
+		NodeCountAlert:                   clusterMonitor.NodeCountAlert,
+		ClusterStateAlert:                clusterMonitor.ClusterStateAlert,
+	}
+}
+
+func (clusterMonitor *clusterHealthMonitor) restoreState(state savedClusterState) {
+	clusterMonitor.LastGoodNodeCountDate = state.LastGoodNodeCountDate
+	clusterMonitor.LastGoodClusterStatusDate = state.LastGoodClusterStatusDate
+	clusterMonitor.LastNodeCountNotificationTime = state.LastNodeCountNotificationTime
+	clusterMonitor.LastClusterStateNotificationDate = state.LastClusterStateNotificationDate
+	clusterMonitor.NodeCountAlert = state.NodeCountAlert
+	clusterMonitor.ClusterStateAlert = state.ClusterStateAlert
+}
+
+func saveRuleState(rule *notificationRule) {
+	err := saveStateFile(statePath(ruleStateFolder, rule.Name), rule.savedState())
+	if err != nil {
+		log.Printf("Error saving state for rule %v : %v", rule.Name, err)
+	}
+}
+
+// Reads the rule's saved state, if it has any, into the rule
+func restoreRuleState(rule *notificationRule) {
+	var state savedRuleState
+	found, err := loadStateFile(statePath(ruleStateFolder, rule.Name), &state)
+	if err != nil {
+		log.Printf("Error reading state for rule %v : %v", rule.Name, err)
+		return
+	}
+
+	if found {
+		rule.restoreState(state)
+	}
+}
+
+// Saves a snapshot of the cluster's health tracking, taken with its monitor locked
+func saveClusterState(clusterName string, state savedClusterState) {
+	err := saveStateFile(statePath(clusterStateFolder, clusterName), state)
+	if err != nil {
+		log.Printf("Error saving state for cluster %v : %v", clusterName, err)
+	}
+}
+
+// Reads the cluster's saved health tracking, if it has any, into the monitor
+func restoreClusterState(clusterMonitor *clusterHealthMonitor) {
+	var state savedClusterState
+	found, err := loadStateFile(statePath(clusterStateFolder, clusterMonitor.ClusterName), &state)
+	if err != nil {
+		log.Printf("Error reading state for cluster %v : %v", clusterMonitor.ClusterName, err)
+		return
+	}
+
+	if found {
+		clusterMonitor.restoreState(state)
+	}
+}
@@ -0,0 +1,75 @@
+package elastic
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func useTemporaryStateDirectory(t *testing.T) func() {
+	stateDir, err := ioutil.TempDir("", "gwylio-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configuration.StateDirectory = stateDir
+	return func() {
+		configuration.StateDirectory = ""
+		os.RemoveAll(stateDir)
+	}
+}
+
+func TestRuleStateRestored(t *testing.T) {
+	defer useTemporaryStateDirectory(t)()
+
+	firingSince := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	rule := notificationRule{Name: "errors/prod", LastProcessedTime: firingSince.Add(time.Minute),
+		LastNotificationSent: firingSince}
+	rule.Alert.fire(firingSince)
+	rule.QueryKeyAlerts = map[string]*queryKeyAlert{"web-1": {LastNotificationSent: firingSince}}
+	saveRuleState(&rule)
+
+	restored := notificationRule{Name: "errors/prod"}
+	restoreRuleState(&restored)
+
+	if !restored.LastProcessedTime.Equal(rule.LastProcessedTime) || !restored.LastNotificationSent.Equal(firingSince) {
+		t.Fail()
+		t.Logf("Rule times should be restored, was %+v", restored.savedState())
+	}
+
+	if !restored.Alert.isFiring() || !restored.Alert.FiringSince.Equal(firingSince) {
+		t.Fail()
+		t.Logf("Rule alert should be restored, was %+v", restored.Alert)
+	}
+
+	if _, ok := restored.QueryKeyAlerts["web-1"]; !ok {
+		t.Fail()
+		t.Logf("query_key alerts should be restored, was %+v", restored.QueryKeyAlerts)
+	}
+
+	missing := notificationRule{Name: "new rule"}
+	restoreRuleState(&missing)
+	if !missing.LastProcessedTime.IsZero() {
+		t.Fail()
+		t.Logf("Rules without saved state should be left alone")
+	}
+}
+
+func TestClusterStateSavedOnChange(t *testing.T) {
+	defer useTemporaryStateDirectory(t)()
+
+	configuration.NotifyOnClusterRed = true
+	defer func() { configuration.NotifyOnClusterRed = false }()
+
+	monitor := &clusterHealthMonitor{ClusterName: "prod"}
+	checkClusterHealth(clusterHealth{ClusterName: "prod", Status: "red"}, monitor, 0)
+
+	restored := &clusterHealthMonitor{ClusterName: "prod"}
+	restoreClusterState(restored)
+
+	if !restored.ClusterStateAlert.isFiring() || restored.LastClusterStateNotificationDate.IsZero() {
+		t.Fail()
+		t.Logf("Cluster state alert should be restored, was %+v", restored.savedState())
+	}
+}
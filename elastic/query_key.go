@@ -0,0 +1,200 @@
+package elastic
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Name of the terms aggregation a grouped rule's query is wrapped in
+const queryKeyAggregationName = "gwylio_query_key"
+
+// Number of query_key values checked when query_key_size isn't set
+const defaultQueryKeySize = 100
+
+// Notification state for one value of a rule's query_key
+type queryKeyAlert struct {
+	LastNotificationSent time.Time
+	Alert                alertState
+}
+
+type queryKeyQueryResult struct {
+	Aggregations map[string]queryKeyAggregation `json:"aggregations"`
+}
+
+type queryKeyAggregation struct {
+	Buckets []queryKeyBucket `json:"buckets"`
+}
+
+type queryKeyBucket struct {
+	Key         json.RawMessage          `json:"key"`
+	KeyAsString string                   `json:"key_as_string"`
+	DocCount    int                      `json:"doc_count"`
+	Metric      *metricAggregationResult `json:"gwylio_metric"`
+}
+
+// Returns the bucket's key as text, without quotes for string keys
+func (bucket queryKeyBucket) keyValue() string {
+	if bucket.KeyAsString != "" {
+		return bucket.KeyAsString
+	}
+
+	var key string
+	if err := json.Unmarshal(bucket.Key, &key); err == nil {
+		return key
+	}
+	return strings.TrimSpace(string(bucket.Key))
+}
+
+// Runs the rule's query grouped by its query_key and returns a result for
+// each value that had matching documents
+func evaluateGroupedRule(rule *notificationRule, hosts []string, version clusterVersion) ([]ruleResult, error) {
+	query, err := buildGroupedQuery(rule)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := failoverHTTPRequest(hosts, "POST", buildRuleURL(rule, version), bytes.NewBuffer(query))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseGroupedQuery(rule, body)
+}
+
+// Wraps the rule's query in a terms aggregation on the query_key. Metric
+// and cardinality rules have their aggregation run inside each bucket.
+func buildGroupedQuery(rule *notificationRule) ([]byte, error) {
+	body := map[string]json.RawMessage{}
+	if len(rule.Query) > 0 {
+		err := json.Unmarshal(rule.Query, &body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	size := rule.QueryKeySize
+	if size <= 0 {
+		size = defaultQueryKeySize
+	}
+
+	terms := map[string]interface{}{
+		"terms": map[string]interface{}{"field": rule.QueryKey, "size": size},
+	}
+
+	if usesAggregation(rule) {
+		terms["aggs"] = map[string]json.RawMessage{metricAggregationName: rule.Aggregation}
+	}
+
+	aggs, err := json.Marshal(map[string]interface{}{queryKeyAggregationName: terms})
+	if err != nil {
+		return nil, err
+	}
+
+	body["size"] = json.RawMessage("0")
+	body["aggs"] = aggs
+
+	return json.Marshal(body)
+}
+
+func parseGroupedQuery(rule *notificationRule, result []byte) ([]ruleResult, error) {
+	var queryResult queryKeyQueryResult
+	err := json.Unmarshal(result, &queryResult)
+	if err != nil {
+		return nil, err
+	}
+
+	aggregation, ok := queryResult.Aggregations[queryKeyAggregationName]
+	if !ok {
+		return nil, errors.New("query_key aggregation missing from response")
+	}
+
+	var results []ruleResult
+	for _, bucket := range aggregation.Buckets {
+		var result ruleResult
+
+		if usesAggregation(rule) {
+			if bucket.Metric == nil {
+				return nil, errors.New("aggregation missing from query_key bucket")
+			}
+
+			value, err := bucket.Metric.value()
+			if err == errNoMetricValue {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			result = aggregationResult(rule, value)
+		} else {
+			result = countResult(bucket.DocCount, nil)
+		}
+
+		result.QueryKeyValue = bucket.keyValue()
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// Checks the threshold for each query_key value separately, each with its
+// own notification interval and alert state
+func processGroupedResults(rule *notificationRule, results []ruleResult, now time.Time) {
+	if rule.QueryKeyAlerts == nil {
+		rule.QueryKeyAlerts = map[string]*queryKeyAlert{}
+	}
+
+	// Every value's result is available to message templates
+	var buckets []notificationBucket
+	for _, result := range results {
+		buckets = append(buckets, notificationBucket{Key: result.QueryKeyValue, Value: result.Value})
+	}
+
+	returned := map[string]bool{}
+	for _, result := range results {
+		result.Buckets = buckets
+
+		returned[result.QueryKeyValue] = true
+
+		state, ok := rule.QueryKeyAlerts[result.QueryKeyValue]
+		if !ok {
+			state = &queryKeyAlert{}
+			rule.QueryKeyAlerts[result.QueryKeyValue] = state
+		}
+
+		notify := evaluateOperator(rule.Operator, result.Value, rule.Threshold)
+		notifyRuleResult(rule, result, notify, &state.LastNotificationSent, &state.Alert)
+	}
+
+	// Values that weren't returned had no matching documents. For a count
+	// or cardinality that is zero, a metric has no value so is resolved.
+	for value, state := range rule.QueryKeyAlerts {
+		if returned[value] {
+			continue
+		}
+
+		result := ruleResult{Description: "No matching documents"}
+		notify := false
+		if rule.Type == "count" {
+			result = countResult(0, nil)
+			notify = evaluateOperator(rule.Operator, 0, rule.Threshold)
+		}
+		if rule.Type == "cardinality" {
+			result = aggregationResult(rule, 0)
+			notify = evaluateOperator(rule.Operator, 0, rule.Threshold)
+		}
+		result.QueryKeyValue = value
+
+		notifyRuleResult(rule, result, notify, &state.LastNotificationSent, &state.Alert)
+	}
+
+	// Forget values that aren't firing once their notification interval is up
+	notificationCutoff := now.Add(time.Hour * time.Duration(rule.NotificationInterval) * -1)
+	for value, state := range rule.QueryKeyAlerts {
+		if !state.Alert.isFiring() && !state.LastNotificationSent.After(notificationCutoff) {
+			delete(rule.QueryKeyAlerts, value)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package elastic
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestBuildGroupedQuery(t *testing.T) {
+	rule := notificationRule{
+		Type:        "metric",
+		QueryKey:    "host",
+		Aggregation: json.RawMessage(`{"sum":{"field":"bytes"}}`),
+		Query:       json.RawMessage(`{"query":{"term":{"status":500}}}`),
+	}
+
+	body, err := buildGroupedQuery(&rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"aggs":{"gwylio_query_key":{"aggs":{"gwylio_metric":{"sum":{"field":"bytes"}}},"terms":{"field":"host","size":100}}},"query":{"term":{"status":500}},"size":0}`
+	if string(body) != expected {
+		t.Fail()
+		t.Logf("Grouped query is incorrect. Should be %v, was %v", expected, string(body))
+	}
+}
+
+func TestParseGroupedQuery(t *testing.T) {
+	response := `{"aggregations":{"gwylio_query_key":{"buckets":[
+		{"key":"web-1","doc_count":150},
+		{"key":404,"doc_count":3}]}}}`
+
+	results, err := parseGroupedQuery(&notificationRule{Type: "count"}, []byte(response))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 2 {
+		t.Fatalf("There should be a result for each bucket, had %v", len(results))
+	}
+
+	if results[0].QueryKeyValue != "web-1" || results[0].Value != 150 {
+		t.Fail()
+		t.Logf("First bucket is incorrect, was %+v", results[0])
+	}
+
+	if results[1].QueryKeyValue != "404" || results[1].Value != 3 {
+		t.Fail()
+		t.Logf("Numeric keys should be read as text, was %+v", results[1])
+	}
+}
+
+func TestParseGroupedMetricQuery(t *testing.T) {
+	response := `{"aggregations":{"gwylio_query_key":{"buckets":[
+		{"key":"web-1","doc_count":10,"gwylio_metric":{"value":812.5}},
+		{"key":"web-2","doc_count":0,"gwylio_metric":{"value":null}}]}}}`
+
+	results, err := parseGroupedQuery(&notificationRule{Type: "metric"}, []byte(response))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 1 {
+		t.Fatalf("Buckets without a metric value should be left out, had %v results", len(results))
+	}
+
+	if results[0].QueryKeyValue != "web-1" || results[0].Value != 812.5 {
+		t.Fail()
+		t.Logf("Metric bucket is incorrect, was %+v", results[0])
+	}
+}
+
+func TestProcessGroupedResults(t *testing.T) {
+	configuration.Notifications = nil
+	rule := notificationRule{
+		Name:                 "Errors per host",
+		Type:                 "count",
+		QueryKey:             "host",
+		Operator:             ">",
+		Threshold:            100,
+		NotificationInterval: 1,
+	}
+
+	processGroupedResults(&rule, []ruleResult{
+		{QueryKeyValue: "web-1", Value: 150},
+		{QueryKeyValue: "web-2", Value: 20},
+	}, time.Now())
+
+	if state, ok := rule.QueryKeyAlerts["web-1"]; !ok || !state.Alert.isFiring() {
+		t.Fail()
+		t.Logf("web-1 is over the threshold and should be firing")
+	}
+
+	if _, ok := rule.QueryKeyAlerts["web-2"]; ok {
+		t.Fail()
+		t.Logf("web-2 never fired and shouldn't be tracked")
+	}
+
+	if !rule.LastNotificationSent.IsZero() || rule.Alert.isFiring() {
+		t.Fail()
+		t.Logf("A grouped rule should track notifications per value, not on the rule")
+	}
+
+	// web-1 has no matching documents on the next run, so its count is zero
+	processGroupedResults(&rule, nil, time.Now())
+
+	if state, ok := rule.QueryKeyAlerts["web-1"]; !ok || state.Alert.State != alertStateResolved {
+		t.Fail()
+		t.Logf("web-1 should be resolved and kept until its notification interval is up")
+	}
+
+	processGroupedResults(&rule, nil, time.Now().Add(time.Hour*2))
+
+	if _, ok := rule.QueryKeyAlerts["web-1"]; ok {
+		t.Fail()
+		t.Logf("web-1 should be forgotten once its notification interval is up")
+	}
+}
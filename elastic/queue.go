@@ -2,43 +2,274 @@ package elastic
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	defaultBulkMaxDocs       = 500
+	defaultBulkMaxBytes      = 5 * 1024 * 1024
+	defaultBulkFlushInterval = 5
+)
+
+// Number of documents that can wait to be sent before they are spooled
+const indexQueueCapacity = 100000
+
+// Mapping type of every document on Elasticsearch 6. _doc is only allowed
+// from 6.2, so doc is used, as Logstash and Beats 6 do.
+const singleMappingTypeName = "doc"
+
 var retryQueue chan indexQueueItem
 
 type indexQueueItem struct {
-	URL     string
+	Index   string
+	DocType string
 	Payload string
 }
 
-func addToIndexQueue(URL string, payload string) {
-	queueItem := indexQueueItem{URL, payload}
+type bulkAction struct {
+	Index bulkActionMetadata `json:"index"`
+}
+
+type bulkActionMetadata struct {
+	Index   string `json:"_index"`
+	DocType string `json:"_type,omitempty"`
+}
+
+type bulkResponse struct {
+	Errors bool                          `json:"errors"`
+	Items  []map[string]bulkResponseItem `json:"items"`
+}
+
+type bulkResponseItem struct {
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+func addToIndexQueue(index string, docType string, payload string) {
+	queueItem := indexQueueItem{index, docType, payload}
+
+	// Keep documents in order behind the ones already waiting in the spool
+	if atomic.LoadInt32(&targetUnreachable) == 1 {
+		spoolItems([]indexQueueItem{queueItem})
+		return
+	}
 
 	select {
 	case retryQueue <- queueItem:
 	default:
-		return
+		spoolItems([]indexQueueItem{queueItem})
 	}
 }
 
 func startRetryQueue() {
-	retryQueue = make(chan indexQueueItem, 100000)
+	retryQueue = make(chan indexQueueItem, indexQueueCapacity)
+
+	go processRetryQueue()
+}
+
+// Sends everything in the index queue and the spool, for when gwylio runs
+// once and exits. Whatever can't be sent is left in the spool for the next run.
+func drainIndexQueue() {
+	var queued []indexQueueItem
+	for len(retryQueue) > 0 {
+		queued = append(queued, <-retryQueue)
+	}
+
+	for start := 0; start < len(queued); start += bulkMaxDocs() {
+		end := start + bulkMaxDocs()
+		if end > len(queued) {
+			end = len(queued)
+		}
+
+		if failed := flushBulkBatch(queued[start:end]); len(failed) > 0 {
+			spoolItems(failed)
+		}
+	}
+
+	for indexSpool.pending() {
+		if !replayOldestSegment() {
+			log.Print("Target cluster is unreachable, documents are left in the spool for the next run")
+			return
+		}
+	}
+}
+
+// Collects queued documents into batches and sends them with the _bulk api once
+// the batch is full or the flush interval has passed
+func processRetryQueue() {
+	ticker := time.NewTicker(time.Second * time.Duration(bulkFlushInterval()))
+
+	var batch []indexQueueItem
+	batchBytes := 0
+
+	for {
+		select {
+		case item := <-retryQueue:
+			batch = append(batch, item)
+			batchBytes += len(item.Payload)
+
+			if len(batch) >= bulkMaxDocs() || batchBytes >= bulkMaxBytes() {
+				batch = flushBulkBatch(batch)
+				batchBytes = batchSize(batch)
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				batch = flushBulkBatch(batch)
+				batchBytes = batchSize(batch)
+			}
+		}
+	}
+}
+
+// Sends the batch to the target cluster. If the target can't be reached the batch is
+// written to the spool to be replayed later. Returns the items that were rejected with
+// a retryable status so they can be sent again with the next batch.
+func flushBulkBatch(batch []indexQueueItem) []indexQueueItem {
+	if atomic.LoadInt32(&targetUnreachable) == 1 {
+		spoolItems(batch)
+		return nil
+	}
+
+	failed, err := sendBulkBatch(batch)
+	if err != nil {
+		log.Print("Documents couldn't be sent to the target cluster, spooling them: ", err)
+		atomic.StoreInt32(&targetUnreachable, 1)
+		spoolItems(batch)
+		return nil
+	}
 
-	go func() {
-		for item := range retryQueue {
-			success := false
-			for !success {
+	return failed
+}
+
+// Sends one _bulk request and returns the items that should be retried
+func sendBulkBatch(batch []indexQueueItem) ([]indexQueueItem, error) {
+	body, err := failoverHTTPRequest(configuration.ElasticClientsTo, "POST",
+		"_bulk", bytes.NewBuffer(buildBulkBody(batch, targetClusterVersion())))
+	if err != nil {
+		return nil, err
+	}
+
+	// Which documents were indexed isn't known, so the batch is sent again
+	failed, err := parseBulkResponse(batch, body)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing bulk response: %v", err)
+	}
+
+	return failed, nil
+}
+
+// Builds the newline delimited body for a _bulk request. Clusters without mapping
+// types, or with only one for each index, get the document type as a type field
+// in the document instead.
+func buildBulkBody(batch []indexQueueItem, version clusterVersion) []byte {
+	var bodyBuffer bytes.Buffer
+
+	for _, item := range batch {
+		action := bulkAction{bulkActionMetadata{item.Index, item.DocType}}
+		payload := item.Payload
+		if version.singleMappingType() {
+			action.Index.DocType = singleMappingTypeName
+			if version.typeless() {
+				action.Index.DocType = ""
+			}
+			payload = addTypeField(payload, item.DocType)
+		}
+		actionBytes, _ := json.Marshal(action)
+
+		bodyBuffer.Write(actionBytes)
+		bodyBuffer.WriteString("\n")
+		bodyBuffer.WriteString(payload)
+		bodyBuffer.WriteString("\n")
+	}
+
+	return bodyBuffer.Bytes()
+}
+
+// Adds a type field to the start of a json document
+func addTypeField(payload string, docType string) string {
+	trimmed := strings.TrimSpace(payload)
+	if !strings.HasPrefix(trimmed, "{") {
+		return payload
+	}
+
+	typeBytes, _ := json.Marshal(docType)
+	typeField := `{"type":` + string(typeBytes)
+
+	rest := strings.TrimSpace(trimmed[1:])
+	if rest == "}" {
+		return typeField + "}"
+	}
+	return typeField + "," + rest
+}
 
-				_, err := failoverHTTPRequest(configuration.ElasticClientsTo, "POST",
-					item.URL, bytes.NewBuffer([]byte(item.Payload)))
+// Matches the per item results of a _bulk response with the batch that was sent
+// and returns the items that should be retried
+func parseBulkResponse(batch []indexQueueItem, body []byte) ([]indexQueueItem, error) {
+	var response bulkResponse
+	err := json.Unmarshal(body, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	var failed []indexQueueItem
+	if !response.Errors {
+		return failed, nil
+	}
 
-				if err != nil {
-					time.Sleep(30 * time.Second)
-				} else {
-					success = true
-				}
+	for i, result := range response.Items {
+		if i >= len(batch) {
+			break
+		}
+
+		for _, item := range result {
+			if item.Status >= 200 && item.Status < 300 {
+				continue
+			}
+
+			// 429 and 5xx responses are temporary, anything else will never succeed
+			if item.Status == 429 || item.Status >= 500 {
+				failed = append(failed, batch[i])
+			} else {
+				atomic.AddUint64(&indexQueueStats.Dropped, 1)
+				log.Printf("Dropping document for index %v, status %v: %v",
+					batch[i].Index, item.Status, string(item.Error))
 			}
 		}
-	}()
+	}
+
+	return failed, nil
+}
+
+func batchSize(batch []indexQueueItem) int {
+	size := 0
+	for _, item := range batch {
+		size += len(item.Payload)
+	}
+	return size
+}
+
+func bulkMaxDocs() int {
+	if configuration.BulkMaxDocs > 0 {
+		return configuration.BulkMaxDocs
+	}
+	return defaultBulkMaxDocs
+}
+
+func bulkMaxBytes() int {
+	if configuration.BulkMaxBytes > 0 {
+		return configuration.BulkMaxBytes
+	}
+	return defaultBulkMaxBytes
+}
+
+func bulkFlushInterval() int {
+	if configuration.BulkFlushInterval > 0 {
+		return configuration.BulkFlushInterval
+	}
+	return defaultBulkFlushInterval
 }
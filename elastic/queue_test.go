@@ -0,0 +1,142 @@
+package elastic
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildBulkBody(t *testing.T) {
+	batch := []indexQueueItem{
+		{".gwylio-2016.08.04", "jvm_stats", `{"node_name":"node-1"}`},
+		{".gwylio-2016.08.04", "os_stats", `{"node_name":"node-2"}`},
+	}
+
+	body := string(buildBulkBody(batch, clusterVersion{Distribution: distributionElasticsearch, Number: "5.6.0", Major: 5}))
+	lines := strings.Split(strings.TrimRight(body, "\n"), "\n")
+
+	if len(lines) != 4 {
+		t.Fail()
+		t.Logf("Bulk body should have 4 lines, had %v", len(lines))
+		return
+	}
+
+	expectedAction := `{"index":{"_index":".gwylio-2016.08.04","_type":"jvm_stats"}}`
+	if lines[0] != expectedAction {
+		t.Fail()
+		t.Logf("Action line is incorrect. Should be %v, was %v", expectedAction, lines[0])
+	}
+
+	if lines[1] != batch[0].Payload {
+		t.Fail()
+		t.Logf("Document line is incorrect. Should be %v, was %v", batch[0].Payload, lines[1])
+	}
+
+	if !strings.HasSuffix(body, "\n") {
+		t.Fail()
+		t.Logf("Bulk body must end with a newline")
+	}
+}
+
+func TestBuildTypelessBulkBody(t *testing.T) {
+	batch := []indexQueueItem{
+		{".gwylio-2016.08.04", "jvm_stats", `{"node_name":"node-1"}`},
+		{".gwylio-2016.08.04", "cluster_stats", `{}`},
+	}
+
+	lines := strings.Split(strings.TrimRight(string(buildBulkBody(batch, clusterVersion{Distribution: distributionElasticsearch, Number: "7.10.0", Major: 7})), "\n"), "\n")
+
+	expectedLines := []string{
+		`{"index":{"_index":".gwylio-2016.08.04"}}`,
+		`{"type":"jvm_stats","node_name":"node-1"}`,
+		`{"index":{"_index":".gwylio-2016.08.04"}}`,
+		`{"type":"cluster_stats"}`,
+	}
+
+	if len(lines) != len(expectedLines) {
+		t.Fatalf("Bulk body should have %v lines, had %v", len(expectedLines), len(lines))
+	}
+
+	for i, expected := range expectedLines {
+		if lines[i] != expected {
+			t.Fail()
+			t.Logf("Line %v is incorrect. Should be %v, was %v", i, expected, lines[i])
+		}
+	}
+}
+
+func TestBuildSingleTypeBulkBody(t *testing.T) {
+	batch := []indexQueueItem{
+		{".gwylio-2016.08.04", "jvm_stats", `{"node_name":"node-1"}`},
+		{".gwylio-2016.08.04", "cluster_stats", `{}`},
+	}
+
+	version := clusterVersion{Distribution: distributionElasticsearch, Number: "6.8.23", Major: 6}
+	lines := strings.Split(strings.TrimRight(string(buildBulkBody(batch, version)), "\n"), "\n")
+
+	expectedLines := []string{
+		`{"index":{"_index":".gwylio-2016.08.04","_type":"doc"}}`,
+		`{"type":"jvm_stats","node_name":"node-1"}`,
+		`{"index":{"_index":".gwylio-2016.08.04","_type":"doc"}}`,
+		`{"type":"cluster_stats"}`,
+	}
+
+	if len(lines) != len(expectedLines) {
+		t.Fatalf("Bulk body should have %v lines, had %v", len(expectedLines), len(lines))
+	}
+
+	for i, expected := range expectedLines {
+		if lines[i] != expected {
+			t.Fail()
+			t.Logf("Line %v is incorrect. Should be %v, was %v", i, expected, lines[i])
+		}
+	}
+}
+
+func TestParseBulkResponseRequeuesRetryableFailures(t *testing.T) {
+	batch := []indexQueueItem{
+		{".gwylio-2016.08.04", "jvm_stats", `{"node_name":"node-1"}`},
+		{".gwylio-2016.08.04", "jvm_stats", `{"node_name":"node-2"}`},
+		{".gwylio-2016.08.04", "jvm_stats", `{"node_name":"node-3"}`},
+	}
+
+	response := `{"took":3,"errors":true,"items":[
+		{"index":{"_index":".gwylio-2016.08.04","status":201}},
+		{"index":{"_index":".gwylio-2016.08.04","status":429,"error":{"type":"es_rejected_execution_exception"}}},
+		{"index":{"_index":".gwylio-2016.08.04","status":400,"error":{"type":"mapper_parsing_exception"}}}]}`
+
+	failed, err := parseBulkResponse(batch, []byte(response))
+	if err != nil {
+		t.Fail()
+		t.Log(err)
+	}
+
+	if len(failed) != 1 {
+		t.Fail()
+		t.Logf("Only the rejected item should be retried, %v items were returned", len(failed))
+		return
+	}
+
+	if failed[0].Payload != batch[1].Payload {
+		t.Fail()
+		t.Logf("Wrong item was retried. Should be %v, was %v", batch[1].Payload, failed[0].Payload)
+	}
+}
+
+func TestParseBulkResponseWithoutErrors(t *testing.T) {
+	batch := []indexQueueItem{
+		{".gwylio-2016.08.04", "jvm_stats", `{"node_name":"node-1"}`},
+	}
+
+	response := `{"took":3,"errors":false,"items":[{"index":{"_index":".gwylio-2016.08.04","status":201}}]}`
+
+	failed, err := parseBulkResponse(batch, []byte(response))
+	if err != nil {
+		t.Fail()
+		t.Log(err)
+	}
+
+	if len(failed) != 0 {
+		t.Fail()
+		t.Logf("No items should be retried, %v items were returned", len(failed))
+	}
+}
@@ -0,0 +1,59 @@
+package elastic
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+func validateRatioRule(rule notificationRule) error {
+	if len(rule.NumeratorQuery) == 0 || len(rule.DenominatorQuery) == 0 {
+		return errors.New("numerator_query and denominator_query must both be set")
+	}
+	return nil
+}
+
+// Counts the documents matching the numerator and denominator queries and
+// compares their ratio with the threshold
+func evaluateRatioRule(rule *notificationRule, hosts []string, ruleURL string) (ruleResult, error) {
+	numerator, err := countForQuery(hosts, ruleURL, rule.NumeratorQuery)
+	if err != nil {
+		return ruleResult{}, err
+	}
+
+	denominator, err := countForQuery(hosts, ruleURL, rule.DenominatorQuery)
+	if err != nil {
+		return ruleResult{}, err
+	}
+
+	value, ok := divideCounts(numerator, denominator)
+	if !ok {
+		return ruleResult{
+			NoValue:     true,
+			Description: fmt.Sprintf("Numerator count was %v, denominator was empty so there is no ratio", numerator),
+		}, nil
+	}
+
+	return ruleResult{
+		Value: value,
+		Description: fmt.Sprintf("Numerator count was %v, denominator count was %v, ratio was %.4g",
+			numerator, denominator, value),
+	}, nil
+}
+
+func countForQuery(hosts []string, ruleURL string, query []byte) (int, error) {
+	body, err := failoverHTTPRequest(hosts, "POST", ruleURL, bytes.NewBuffer(query))
+	if err != nil {
+		return -1, err
+	}
+
+	return parseCountQuery(body)
+}
+
+// With nothing in the denominator there is no ratio, and false is returned
+func divideCounts(numerator int, denominator int) (float64, bool) {
+	if denominator == 0 {
+		return 0, false
+	}
+	return float64(numerator) / float64(denominator), true
+}
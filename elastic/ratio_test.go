@@ -0,0 +1,93 @@
+package elastic
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEvaluateRatioRule(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if strings.Contains(string(body), "status") {
+			fmt.Fprint(w, `{"count":25}`)
+			return
+		}
+		fmt.Fprint(w, `{"count":1000}`)
+	}))
+	defer testServer.Close()
+
+	rule := notificationRule{
+		Type:             "ratio",
+		IndexName:        "logstash-*",
+		NumeratorQuery:   json.RawMessage(`{"query":{"range":{"status":{"gte":500}}}}`),
+		DenominatorQuery: json.RawMessage(`{"query":{"match_all":{}}}`),
+	}
+
+	ruleURL := buildRuleURL(&rule, clusterVersion{})
+	if ruleURL != "logstash-*/_count" {
+		t.Fail()
+		t.Logf("Ratio rules should send count queries, url was %v", ruleURL)
+	}
+
+	result, err := evaluateRatioRule(&rule, []string{testServer.URL}, ruleURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Value != 0.025 {
+		t.Fail()
+		t.Logf("Ratio should be 0.025, was %v", result.Value)
+	}
+
+	expected := "Numerator count was 25, denominator count was 1000, ratio was 0.025"
+	if result.Description != expected {
+		t.Fail()
+		t.Logf("Description is incorrect. Should be %v, was %v", expected, result.Description)
+	}
+}
+
+func TestRatioRuleWithoutDenominator(t *testing.T) {
+	defer useTemporaryStateDirectory(t)()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"count":0}`)
+	}))
+	defer server.Close()
+
+	configuration.ElasticClientsFrom = []elasticHostConfig{{ClusterName: "prod", Hosts: []string{server.URL}}}
+	configureHostClients()
+	defer func() { configuration.ElasticClientsFrom = nil }()
+
+	rule := notificationRule{
+		Name:             "Success rate",
+		Type:             "ratio",
+		ClusterName:      "prod",
+		IndexName:        "logstash-*",
+		Operator:         "<",
+		Threshold:        0.95,
+		NumeratorQuery:   json.RawMessage(`{"query":{"range":{"status":{"lt":500}}}}`),
+		DenominatorQuery: json.RawMessage(`{"query":{"match_all":{}}}`),
+	}
+
+	result, err := evaluateRatioRule(&rule, []string{server.URL}, buildRuleURL(&rule, clusterVersion{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !result.NoValue || !strings.Contains(result.Description, "denominator was empty") {
+		t.Fail()
+		t.Logf("A ratio with an empty denominator should have no value, was %v: %v", result.Value, result.Description)
+	}
+
+	processNotificationRule(&rule)
+
+	if rule.Alert.isFiring() || !rule.LastNotificationSent.IsZero() {
+		t.Fail()
+		t.Logf("A ratio with an empty denominator should not match %v %v", rule.Operator, rule.Threshold)
+	}
+}
@@ -0,0 +1,244 @@
+package elastic
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Name of the aggregation a metric rule's query is wrapped in
+const metricAggregationName = "gwylio_metric"
+
+// The value a rule's query produced, and how to describe it in a notification
+type ruleResult struct {
+	QueryKeyValue string
+	Value         float64
+	Description   string
+	Attachment    []byte
+	Buckets       []notificationBucket
+
+	// True if a metric had no documents to aggregate, so there was no
+	// value to compare with the threshold
+	NoValue bool
+}
+
+type metricQueryResult struct {
+	Aggregations map[string]metricAggregationResult `json:"aggregations"`
+}
+
+// Single value aggregations return value, percentiles return a map of values
+type metricAggregationResult struct {
+	Value  *float64            `json:"value"`
+	Values map[string]*float64 `json:"values"`
+}
+
+var errNoMetricValue = errors.New("aggregation returned no value")
+
+// Runs the rule's query and returns the value to compare with its threshold
+func evaluateRule(rule *notificationRule, hosts []string, version clusterVersion) (ruleResult, error) {
+	ruleURL := buildRuleURL(rule, version)
+
+	switch rule.Type {
+	case "count", "flatline":
+		body, err := failoverHTTPRequest(hosts, "POST", ruleURL, bytes.NewBuffer([]byte(rule.Query)))
+		if err != nil {
+			return ruleResult{}, err
+		}
+
+		hitCount, err := parseCountQuery(body)
+		if err != nil {
+			return ruleResult{}, err
+		}
+		return countResult(hitCount, nil), nil
+
+	case "search":
+		query, err := buildSearchQuery(rule.Query, version)
+		if err != nil {
+			return ruleResult{}, err
+		}
+
+		body, err := failoverHTTPRequest(hosts, "POST", ruleURL, bytes.NewBuffer(query))
+		if err != nil {
+			return ruleResult{}, err
+		}
+
+		hitCount, queryResults, err := parseSearchQuery(body)
+		if err != nil {
+			return ruleResult{}, err
+		}
+		return countResult(hitCount, queryResults), nil
+
+	case "metric", "cardinality":
+		query, err := buildMetricQuery(rule.Query, rule.Aggregation)
+		if err != nil {
+			return ruleResult{}, err
+		}
+
+		body, err := failoverHTTPRequest(hosts, "POST", ruleURL, bytes.NewBuffer(query))
+		if err != nil {
+			return ruleResult{}, err
+		}
+
+		value, err := parseMetricQuery(body)
+		if err == errNoMetricValue {
+			return ruleResult{NoValue: true, Description: "No matching documents"}, nil
+		}
+		if err != nil {
+			return ruleResult{}, err
+		}
+		return aggregationResult(rule, value), nil
+
+	case "spike":
+		return evaluateSpikeRule(rule, hosts, ruleURL)
+
+	case "ratio":
+		return evaluateRatioRule(rule, hosts, ruleURL)
+	}
+
+	return ruleResult{}, fmt.Errorf("unknown rule type %v", rule.Type)
+}
+
+// Metric and cardinality rules compare the value of an aggregation
+func usesAggregation(rule *notificationRule) bool {
+	return rule.Type == "metric" || rule.Type == "cardinality"
+}
+
+func aggregationResult(rule *notificationRule, value float64) ruleResult {
+	if rule.Type == "cardinality" {
+		return ruleResult{Value: value, Description: fmt.Sprintf("Distinct count of %v was %v", rule.CardinalityField, value)}
+	}
+	return ruleResult{Value: value, Description: fmt.Sprintf("Metric value was %v", value)}
+}
+
+// Counts the distinct values of a field. The count is approximate for
+// fields with many thousands of values.
+func buildCardinalityAggregation(field string) json.RawMessage {
+	aggregation, _ := json.Marshal(map[string]interface{}{
+		"cardinality": map[string]string{"field": field},
+	})
+	return aggregation
+}
+
+func countResult(hitCount int, queryResults []byte) ruleResult {
+	return ruleResult{
+		Value:       float64(hitCount),
+		Description: fmt.Sprintf("Result count was %v", hitCount),
+		Attachment:  queryResults,
+	}
+}
+
+var ruleTypes = []string{"count", "search", "metric", "cardinality", "flatline", "spike", "ratio", "new_term"}
+
+func validRuleType(ruleType string) bool {
+	for _, known := range ruleTypes {
+		if ruleType == known {
+			return true
+		}
+	}
+	return false
+}
+
+func validOperator(operator string) bool {
+	switch operator {
+	case "eq", "==", "neq", "!=", "<>", "gt", ">", "gte", ">=", "lt", "<", "lte", "<=":
+		return true
+	}
+	return false
+}
+
+// Compares a rule's value with its threshold
+func evaluateOperator(operator string, value float64, threshold float64) bool {
+	switch operator {
+	case "eq", "==":
+		return value == threshold
+	case "neq", "!=", "<>":
+		return value != threshold
+	case "gt", ">":
+		return value > threshold
+	case "gte", ">=":
+		return value >= threshold
+	case "lt", "<":
+		return value < threshold
+	case "lte", "<=":
+		return value <= threshold
+	}
+	return false
+}
+
+// Adds the rule's aggregation to its query. Only the aggregation is
+// returned, not the documents.
+func buildMetricQuery(query json.RawMessage, aggregation json.RawMessage) ([]byte, error) {
+	body := map[string]json.RawMessage{}
+	if len(query) > 0 {
+		err := json.Unmarshal(query, &body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	aggs, err := json.Marshal(map[string]json.RawMessage{metricAggregationName: aggregation})
+	if err != nil {
+		return nil, err
+	}
+
+	body["size"] = json.RawMessage("0")
+	body["aggs"] = aggs
+
+	return json.Marshal(body)
+}
+
+// Asks for an exact hits.total on clusters that would otherwise stop
+// counting at 10000, unless the rule's query sets track_total_hits itself
+func buildSearchQuery(query json.RawMessage, version clusterVersion) ([]byte, error) {
+	if !version.capsHitTotal() {
+		return query, nil
+	}
+
+	body := map[string]json.RawMessage{}
+	if len(query) > 0 {
+		err := json.Unmarshal(query, &body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if _, ok := body["track_total_hits"]; !ok {
+		body["track_total_hits"] = json.RawMessage("true")
+	}
+
+	return json.Marshal(body)
+}
+
+func parseMetricQuery(result []byte) (float64, error) {
+	var queryResult metricQueryResult
+	err := json.Unmarshal(result, &queryResult)
+	if err != nil {
+		return 0, err
+	}
+
+	aggregation, ok := queryResult.Aggregations[metricAggregationName]
+	if !ok {
+		return 0, errors.New("aggregation missing from response")
+	}
+
+	return aggregation.value()
+}
+
+func (aggregation metricAggregationResult) value() (float64, error) {
+	if aggregation.Value != nil {
+		return *aggregation.Value, nil
+	}
+
+	if len(aggregation.Values) > 1 {
+		return 0, errors.New("percentiles aggregation must ask for a single percent")
+	}
+
+	for _, value := range aggregation.Values {
+		if value != nil {
+			return *value, nil
+		}
+	}
+
+	return 0, errNoMetricValue
+}
@@ -0,0 +1,202 @@
+package elastic
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvaluateOperator(t *testing.T) {
+	tests := []struct {
+		operator  string
+		value     float64
+		threshold float64
+		expected  bool
+	}{
+		{">", 10.5, 10, true},
+		{"gt", 10, 10, false},
+		{">=", 10, 10, true},
+		{"lt", 9.99, 10, true},
+		{"<=", 10.01, 10, false},
+		{"==", 3, 3, true},
+		{"<>", 3, 3, false},
+		{"bogus", 3, 3, false},
+	}
+
+	for _, test := range tests {
+		if evaluateOperator(test.operator, test.value, test.threshold) != test.expected {
+			t.Fail()
+			t.Logf("%v %v %v should be %v", test.value, test.operator, test.threshold, test.expected)
+		}
+	}
+}
+
+func TestBuildMetricQuery(t *testing.T) {
+	query := json.RawMessage(`{"query":{"range":{"timestamp":{"gte":"now-5m"}}}}`)
+	aggregation := json.RawMessage(`{"percentiles":{"field":"response_time","percents":[95]}}`)
+
+	body, err := buildMetricQuery(query, aggregation)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parsed map[string]interface{}
+	err = json.Unmarshal(body, &parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed["size"] != float64(0) {
+		t.Fail()
+		t.Logf("Metric query should not return documents, size was %v", parsed["size"])
+	}
+
+	if _, ok := parsed["query"]; !ok {
+		t.Fail()
+		t.Logf("Metric query should keep the rule's query: %v", string(body))
+	}
+
+	aggs, _ := parsed["aggs"].(map[string]interface{})
+	if _, ok := aggs[metricAggregationName]; !ok {
+		t.Fail()
+		t.Logf("Metric query should include the rule's aggregation: %v", string(body))
+	}
+}
+
+func TestParseMetricQuery(t *testing.T) {
+	tests := []struct {
+		response string
+		expected float64
+	}{
+		{`{"aggregations":{"gwylio_metric":{"value":125.5}}}`, 125.5},
+		{`{"aggregations":{"gwylio_metric":{"values":{"95.0":812.25}}}}`, 812.25},
+	}
+
+	for _, test := range tests {
+		value, err := parseMetricQuery([]byte(test.response))
+		if err != nil {
+			t.Fail()
+			t.Log(err)
+			continue
+		}
+
+		if value != test.expected {
+			t.Fail()
+			t.Logf("Metric value should be %v, was %v", test.expected, value)
+		}
+	}
+}
+
+func TestParseMetricQueryWithoutValue(t *testing.T) {
+	responses := []string{
+		`{"aggregations":{"gwylio_metric":{"value":null}}}`,
+		`{"aggregations":{"gwylio_metric":{"values":{"50.0":1,"95.0":2}}}}`,
+		`{"aggregations":{}}`,
+	}
+
+	for _, response := range responses {
+		_, err := parseMetricQuery([]byte(response))
+		if err == nil {
+			t.Fail()
+			t.Logf("Parsing should fail for %v", response)
+		}
+	}
+}
+
+func TestMetricRuleWithoutValue(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"aggregations":{"gwylio_metric":{"value":null}}}`))
+	}))
+	defer server.Close()
+
+	configuration.ElasticClientsFrom = []elasticHostConfig{{ClusterName: "prod", Hosts: []string{server.URL}}}
+	configureHostClients()
+	defer func() { configuration.ElasticClientsFrom = nil }()
+
+	rule := notificationRule{Name: "Latency", Type: "metric", ClusterName: "prod", Operator: "<", Threshold: 10,
+		Aggregation: json.RawMessage(`{"avg":{"field":"response_time"}}`)}
+	rule.Alert.fire(time.Now().Add(time.Minute * -5))
+
+	processNotificationRule(&rule)
+
+	if rule.ConsecutiveQueryErrors != 0 || rule.LastQueryError != "" {
+		t.Fail()
+		t.Logf("A metric without a value should not be a query error, was %v", rule.LastQueryError)
+	}
+
+	if rule.Alert.isFiring() {
+		t.Fail()
+		t.Logf("A metric without a value should not match, so the alert should be resolved")
+	}
+}
+
+func TestCardinalityRule(t *testing.T) {
+	rule := notificationRule{Type: "cardinality", CardinalityField: "username"}
+	rule.Aggregation = buildCardinalityAggregation(rule.CardinalityField)
+
+	expected := `{"cardinality":{"field":"username"}}`
+	if string(rule.Aggregation) != expected {
+		t.Fail()
+		t.Logf("Cardinality aggregation is incorrect. Should be %v, was %v", expected, string(rule.Aggregation))
+	}
+
+	if buildRuleURL(&rule, clusterVersion{}) != "*/_search" {
+		t.Fail()
+		t.Logf("Cardinality rules should search, url was %v", buildRuleURL(&rule, clusterVersion{}))
+	}
+
+	value, err := parseMetricQuery([]byte(`{"aggregations":{"gwylio_metric":{"value":73}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := aggregationResult(&rule, value)
+	if result.Value != 73 || result.Description != "Distinct count of username was 73" {
+		t.Fail()
+		t.Logf("Cardinality result is incorrect, was %+v", result)
+	}
+}
+
+func TestSearchRuleTracksTotalHits(t *testing.T) {
+	var lastQuery string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lastQuery = string(body)
+		w.Write([]byte(`{"hits":{"total":{"value":15000,"relation":"eq"},"hits":[]}}`))
+	}))
+	defer server.Close()
+
+	rule := notificationRule{Name: "Failed logins", Type: "search", IndexName: "auth-*",
+		Query: json.RawMessage(`{"query":{"match":{"outcome":"failure"}}}`)}
+
+	result, err := evaluateRule(&rule, []string{server.URL},
+		clusterVersion{Distribution: distributionElasticsearch, Number: "7.17.9", Major: 7, Minor: 17})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(lastQuery, `"track_total_hits":true`) || !strings.Contains(lastQuery, `"outcome":"failure"`) {
+		t.Fail()
+		t.Logf("Searches on Elasticsearch 7 should ask for an exact total, query was %v", lastQuery)
+	}
+
+	if result.Value != 15000 {
+		t.Fail()
+		t.Logf("Result should be the exact total, was %v", result.Value)
+	}
+
+	_, err = evaluateRule(&rule, []string{server.URL},
+		clusterVersion{Distribution: distributionElasticsearch, Number: "6.8.23", Major: 6, Minor: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(lastQuery, "track_total_hits") {
+		t.Fail()
+		t.Logf("Searches on Elasticsearch 6 always have an exact total, query was %v", lastQuery)
+	}
+}
@@ -0,0 +1,129 @@
+package elastic
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Credentials and TLS settings used to talk to a secured cluster
+type clientSecurityConfig struct {
+	Username           string `yaml:"username"`
+	Password           string `yaml:"password"`
+	APIKey             string `yaml:"api_key"`
+	BearerToken        string `yaml:"bearer_token"`
+	CAFile             string `yaml:"ca_file"`
+	ClientCertFile     string `yaml:"client_cert_file"`
+	ClientKeyFile      string `yaml:"client_key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+type hostClient struct {
+	Client   *http.Client
+	Security clientSecurityConfig
+}
+
+// The http client to use for each configured host. Hosts that aren't
+// configured, like notification endpoints, use a plain client.
+var hostClients = map[string]hostClient{}
+
+func configureHostClients() {
+	hostClients = map[string]hostClient{}
+
+	for _, cluster := range configuration.ElasticClientsFrom {
+		err := addHostClients(cluster.Hosts, cluster.Security)
+		if err != nil {
+			log.Fatalf("Error configuring security for cluster %v: %v", cluster.ClusterName, err)
+		}
+	}
+
+	err := addHostClients(configuration.ElasticClientsTo, configuration.ElasticClientsToSecurity)
+	if err != nil {
+		log.Fatal("Error configuring security for elastic_clients_to: ", err)
+	}
+}
+
+func addHostClients(hosts []string, security clientSecurityConfig) error {
+	client, err := buildHTTPClient(security)
+	if err != nil {
+		return err
+	}
+
+	for _, host := range hosts {
+		if existing, ok := hostClients[host]; ok && existing.Security != security {
+			log.Print("Host is configured more than once with different security settings, using the first: ", host)
+			continue
+		}
+		hostClients[host] = hostClient{client, security}
+	}
+
+	return nil
+}
+
+func buildHTTPClient(security clientSecurityConfig) (*http.Client, error) {
+	client := &http.Client{
+		Timeout: time.Duration(10 * time.Second),
+	}
+
+	if security.CAFile == "" && security.ClientCertFile == "" && !security.InsecureSkipVerify {
+		return client, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: security.InsecureSkipVerify}
+
+	if security.CAFile != "" {
+		caBundle, err := ioutil.ReadFile(security.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caBundle) {
+			return nil, errors.New("no certificates could be read from " + security.CAFile)
+		}
+	}
+
+	if security.ClientCertFile != "" || security.ClientKeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(security.ClientCertFile, security.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	client.Transport = &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}
+
+	return client, nil
+}
+
+// Returns the client and security settings for a host
+func clientForHost(host string) (*http.Client, clientSecurityConfig) {
+	if configured, ok := hostClients[host]; ok {
+		return configured.Client, configured.Security
+	}
+
+	client := &http.Client{
+		Timeout: time.Duration(10 * time.Second),
+	}
+	return client, clientSecurityConfig{}
+}
+
+// Adds the configured credentials to the request. Only one kind is used,
+// with an API key taking priority over a bearer token over basic auth.
+func addAuthentication(req *http.Request, security clientSecurityConfig) {
+	switch {
+	case security.APIKey != "":
+		req.Header.Set("Authorization", "ApiKey "+security.APIKey)
+	case security.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+security.BearerToken)
+	case security.Username != "":
+		req.SetBasicAuth(security.Username, security.Password)
+	}
+}
@@ -0,0 +1,91 @@
+package elastic
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExecuteHTTPRequestWithBasicAuthAndCA(t *testing.T) {
+	testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "elastic" || password != "changeme" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintln(w, "authenticated")
+	}))
+	defer testServer.Close()
+
+	caFile, _ := ioutil.TempFile("", "gwylio-ca")
+	defer os.Remove(caFile.Name())
+	pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: testServer.Certificate().Raw})
+	caFile.Close()
+
+	hostClients = map[string]hostClient{}
+	defer func() { hostClients = map[string]hostClient{} }()
+
+	err := addHostClients([]string{testServer.URL},
+		clientSecurityConfig{Username: "elastic", Password: "changeme", CAFile: caFile.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := failoverHTTPRequest([]string{testServer.URL}, "GET", "/", nil)
+	if err != nil {
+		t.Fail()
+		t.Log(err)
+	}
+
+	if !strings.Contains(string(body), "authenticated") {
+		t.Fail()
+		t.Log("Request should have been authenticated, was ", string(body))
+	}
+}
+
+func TestExecuteHTTPRequestWithoutCAFails(t *testing.T) {
+	testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "testServer")
+	}))
+	defer testServer.Close()
+
+	hostClients = map[string]hostClient{}
+
+	_, err := failoverHTTPRequest([]string{testServer.URL}, "GET", "/", nil)
+	if err == nil {
+		t.Fail()
+		t.Log("Request to a server with an unknown certificate should fail")
+	}
+
+	addHostClients([]string{testServer.URL}, clientSecurityConfig{InsecureSkipVerify: true})
+	defer func() { hostClients = map[string]hostClient{} }()
+
+	_, err = failoverHTTPRequest([]string{testServer.URL}, "GET", "/", nil)
+	if err != nil {
+		t.Fail()
+		t.Log("Request should succeed with insecure_skip_verify: ", err)
+	}
+}
+
+func TestAddAuthentication(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://localhost:9200", nil)
+	addAuthentication(req, clientSecurityConfig{Username: "elastic", Password: "changeme", APIKey: "a2V5"})
+
+	if req.Header.Get("Authorization") != "ApiKey a2V5" {
+		t.Fail()
+		t.Logf("API key should take priority over basic auth, header was %v", req.Header.Get("Authorization"))
+	}
+
+	req, _ = http.NewRequest("GET", "http://localhost:9200", nil)
+	addAuthentication(req, clientSecurityConfig{BearerToken: "t0ken"})
+
+	if req.Header.Get("Authorization") != "Bearer t0ken" {
+		t.Fail()
+		t.Logf("Bearer token header is incorrect, was %v", req.Header.Get("Authorization"))
+	}
+}
@@ -0,0 +1,44 @@
+package elastic
+
+import (
+	"fmt"
+)
+
+const (
+	severityCritical = "critical"
+	severityWarning  = "warning"
+	severityInfo     = "info"
+)
+
+// Severity of rules that don't set one
+const defaultRuleSeverity = severityCritical
+
+func validSeverity(severity string) bool {
+	return severity == severityCritical || severity == severityWarning || severity == severityInfo
+}
+
+// A red cluster is critical, a yellow one is a warning
+func clusterStateSeverity(state string) string {
+	if state == "yellow" {
+		return severityWarning
+	}
+	return severityCritical
+}
+
+// Returns the notifiers for a severity from notification_routing, or the
+// notifications list if the severity isn't routed
+func notifiersFor(severity string) []string {
+	if notifiers, ok := configuration.NotificationRouting[severity]; ok {
+		return notifiers
+	}
+	return configuration.Notifications
+}
+
+func validateNotificationRouting() error {
+	for severity := range configuration.NotificationRouting {
+		if !validSeverity(severity) {
+			return fmt.Errorf("unknown severity %v in notification_routing", severity)
+		}
+	}
+	return nil
+}
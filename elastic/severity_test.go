@@ -0,0 +1,58 @@
+package elastic
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNotifiersForSeverity(t *testing.T) {
+	configuration.Notifications = []string{"slack"}
+	configuration.NotificationRouting = map[string][]string{
+		severityCritical: {"slack", "email", "pagerduty"},
+	}
+	defer func() {
+		configuration.Notifications = nil
+		configuration.NotificationRouting = nil
+	}()
+
+	if strings.Join(notifiersFor(severityCritical), ",") != "slack,email,pagerduty" {
+		t.Fail()
+		t.Logf("Critical alerts should use their route, was %v", notifiersFor(severityCritical))
+	}
+
+	if strings.Join(notifiersFor(severityWarning), ",") != "slack" {
+		t.Fail()
+		t.Logf("Severities without a route should use notifications, was %v", notifiersFor(severityWarning))
+	}
+}
+
+func TestValidateNotificationRouting(t *testing.T) {
+	configuration.NotificationRouting = map[string][]string{"urgent": {"slack"}}
+	defer func() { configuration.NotificationRouting = nil }()
+
+	if validateNotificationRouting() == nil {
+		t.Fail()
+		t.Logf("An unknown severity in notification_routing should not be valid")
+	}
+}
+
+func TestClusterStateSeverity(t *testing.T) {
+	if clusterStateSeverity("red") != severityCritical || clusterStateSeverity("yellow") != severityWarning {
+		t.Fail()
+		t.Logf("Red clusters should be critical and yellow clusters warnings")
+	}
+}
+
+func TestPagerDutyEventSeverity(t *testing.T) {
+	event := buildPagerDutyEvent(pagerDutyNotificationSetting{}, alertNotification{Status: alertStateFiring, Severity: severityWarning})
+	if event.Payload.Severity != severityWarning {
+		t.Fail()
+		t.Logf("PagerDuty severity should match the alert, was %v", event.Payload.Severity)
+	}
+
+	event = buildPagerDutyEvent(pagerDutyNotificationSetting{}, alertNotification{Status: alertStateFiring})
+	if event.Payload.Severity != severityCritical {
+		t.Fail()
+		t.Logf("Alerts without a severity should be critical, was %v", event.Payload.Severity)
+	}
+}
@@ -0,0 +1,482 @@
+package elastic
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Name of the state file silences created through the status API are saved in
+const silenceStateFile = "silences.json"
+
+// Suppresses notifications for alerts that match it while it is active.
+// Silences from gwylio.yml have a schedule that repeats every week, ones
+// created at runtime have a start and end time.
+type silence struct {
+	ID            string           `yaml:"id" json:"id"`
+	Comment       string           `yaml:"comment" json:"comment,omitempty"`
+	CreatedBy     string           `yaml:"created_by" json:"created_by,omitempty"`
+	ClusterName   string           `yaml:"cluster_name" json:"cluster_name,omitempty"`
+	RuleName      string           `yaml:"rule_name" json:"rule_name,omitempty"`
+	Severity      string           `yaml:"severity" json:"severity,omitempty"`
+	QueryKeyValue string           `yaml:"query_key_value" json:"query_key_value,omitempty"`
+	StartsAt      time.Time        `yaml:"starts_at" json:"starts_at,omitempty"`
+	EndsAt        time.Time        `yaml:"ends_at" json:"ends_at,omitempty"`
+	Schedule      *silenceSchedule `yaml:"schedule" json:"schedule,omitempty"`
+}
+
+// A weekly maintenance window. A window with an end before its start runs
+// over midnight into the next day.
+type silenceSchedule struct {
+	Days     []string `yaml:"days" json:"days,omitempty"`
+	Start    string   `yaml:"start" json:"start"`
+	End      string   `yaml:"end" json:"end"`
+	Timezone string   `yaml:"timezone" json:"timezone,omitempty"`
+}
+
+// A silence as shown by the status API
+type silenceStatus struct {
+	silence
+	Source     string `json:"source"`
+	Active     bool   `json:"active"`
+	Suppressed uint64 `json:"suppressed"`
+}
+
+// The body of a request to create a silence. Either ends_at or duration
+// has to be set.
+type silenceRequest struct {
+	silence
+	Duration string `json:"duration"`
+}
+
+var (
+	runtimeSilences     []silence
+	runtimeSilencesLock sync.RWMutex
+
+	// Number of notifications each silence has suppressed, by ID
+	silenceSuppressed     = map[string]uint64{}
+	silenceSuppressedLock sync.Mutex
+)
+
+// Returns true if the alert matches every matcher the silence has. Matchers
+// can use shell patterns, like "logs-*".
+func (s silence) matches(alert alertNotification) bool {
+	matchers := []struct{ pattern, value string }{
+		{s.ClusterName, alert.ClusterName},
+		{s.RuleName, alert.RuleName},
+		{s.Severity, alert.Severity},
+		{s.QueryKeyValue, alert.QueryKeyValue},
+	}
+
+	for _, matcher := range matchers {
+		if matcher.pattern == "" {
+			continue
+		}
+
+		matched, err := path.Match(matcher.pattern, matcher.value)
+		if err != nil || !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s silence) isActive(now time.Time) bool {
+	if s.Schedule != nil {
+		active, err := s.Schedule.isActive(now)
+		return err == nil && active
+	}
+
+	if !s.StartsAt.IsZero() && now.Before(s.StartsAt) {
+		return false
+	}
+	return now.Before(s.EndsAt)
+}
+
+func (schedule silenceSchedule) isActive(now time.Time) (bool, error) {
+	location, err := schedule.location()
+	if err != nil {
+		return false, err
+	}
+
+	start, err := parseScheduleTime(schedule.Start)
+	if err != nil {
+		return false, err
+	}
+
+	end, err := parseScheduleTime(schedule.End)
+	if err != nil {
+		return false, err
+	}
+
+	now = now.In(location)
+	minute := now.Hour()*60 + now.Minute()
+
+	if start <= end {
+		return schedule.includesDay(now.Weekday()) && minute >= start && minute < end, nil
+	}
+
+	// The window runs over midnight, so the early part of it belongs to the
+	// day before
+	if minute >= start {
+		return schedule.includesDay(now.Weekday()), nil
+	}
+	if minute < end {
+		return schedule.includesDay(now.AddDate(0, 0, -1).Weekday()), nil
+	}
+	return false, nil
+}
+
+// A schedule without days runs every day
+func (schedule silenceSchedule) includesDay(day time.Weekday) bool {
+	if len(schedule.Days) == 0 {
+		return true
+	}
+
+	for _, scheduledDay := range schedule.Days {
+		if strings.EqualFold(scheduledDay, day.String()) || strings.EqualFold(scheduledDay, day.String()[:3]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (schedule silenceSchedule) location() (*time.Location, error) {
+	if schedule.Timezone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(schedule.Timezone)
+}
+
+// Returns a time of day written as HH:MM in minutes since midnight
+func parseScheduleTime(value string) (int, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid time %q, should be HH:MM", value)
+	}
+
+	hour, err := strconv.Atoi(parts[0])
+	if err != nil || hour < 0 || hour > 24 {
+		return 0, fmt.Errorf("invalid time %q, should be HH:MM", value)
+	}
+
+	minute, err := strconv.Atoi(parts[1])
+	if err != nil || minute < 0 || minute > 59 || (hour == 24 && minute != 0) {
+		return 0, fmt.Errorf("invalid time %q, should be HH:MM", value)
+	}
+
+	return hour*60 + minute, nil
+}
+
+func validateSilence(s silence) error {
+	// A silence without matchers would match every alert
+	if s.ClusterName == "" && s.RuleName == "" && s.Severity == "" && s.QueryKeyValue == "" {
+		return errors.New(`at least one of cluster_name, rule_name, severity or query_key_value must be set, "*" matches every alert`)
+	}
+
+	if s.Schedule == nil {
+		if s.EndsAt.IsZero() {
+			return errors.New("either a schedule or ends_at must be set")
+		}
+		if !s.StartsAt.IsZero() && !s.EndsAt.After(s.StartsAt) {
+			return errors.New("ends_at must be after starts_at")
+		}
+		return nil
+	}
+
+	if _, err := parseScheduleTime(s.Schedule.Start); err != nil {
+		return err
+	}
+	if _, err := parseScheduleTime(s.Schedule.End); err != nil {
+		return err
+	}
+	if _, err := s.Schedule.location(); err != nil {
+		return err
+	}
+
+	for _, day := range s.Schedule.Days {
+		if !validScheduleDay(day) {
+			return fmt.Errorf("invalid day %q", day)
+		}
+	}
+
+	return nil
+}
+
+func validScheduleDay(day string) bool {
+	for weekday := time.Sunday; weekday <= time.Saturday; weekday++ {
+		if strings.EqualFold(day, weekday.String()) || strings.EqualFold(day, weekday.String()[:3]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the silences in gwylio.yml, giving ones without an ID one based on
+// their position
+func validateConfiguredSilences() []error {
+	var errs []error
+	for i := range configuration.Silences {
+		if configuration.Silences[i].ID == "" {
+			configuration.Silences[i].ID = fmt.Sprintf("config-%v", i+1)
+		}
+
+		err := validateSilence(configuration.Silences[i])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid silence %v: %v", configuration.Silences[i].ID, err))
+		}
+	}
+	return errs
+}
+
+// Returns the first active silence the alert matches, if there is one
+func activeSilence(alert alertNotification, now time.Time) (silence, bool) {
+	for _, s := range configuration.Silences {
+		if s.isActive(now) && s.matches(alert) {
+			return s, true
+		}
+	}
+
+	runtimeSilencesLock.RLock()
+	defer runtimeSilencesLock.RUnlock()
+
+	for _, s := range runtimeSilences {
+		if s.isActive(now) && s.matches(alert) {
+			return s, true
+		}
+	}
+
+	return silence{}, false
+}
+
+func recordSuppressed(s silence) {
+	silenceSuppressedLock.Lock()
+	defer silenceSuppressedLock.Unlock()
+	silenceSuppressed[s.ID]++
+}
+
+func suppressedCount(id string) uint64 {
+	silenceSuppressedLock.Lock()
+	defer silenceSuppressedLock.Unlock()
+	return silenceSuppressed[id]
+}
+
+// Reads the silences created through the status API from the state directory
+func loadSilences() {
+	var silences []silence
+	_, err := loadStateFile(filepath.Join(stateDirectory(), silenceStateFile), &silences)
+	if err != nil {
+		log.Print("Error reading silences: ", err)
+		return
+	}
+
+	runtimeSilencesLock.Lock()
+	runtimeSilences = silences
+	runtimeSilencesLock.Unlock()
+
+	if len(silences) > 0 {
+		log.Printf("Loaded %v silences", len(silences))
+	}
+}
+
+// Saves the silences created through the status API. Expired ones are
+// dropped first. Must be called with runtimeSilencesLock held.
+func saveSilences(now time.Time) error {
+	var current []silence
+	for _, s := range runtimeSilences {
+		if now.Before(s.EndsAt) {
+			current = append(current, s)
+		}
+	}
+	runtimeSilences = current
+
+	return saveStateFile(filepath.Join(stateDirectory(), silenceStateFile), runtimeSilences)
+}
+
+func addSilence(request silenceRequest, now time.Time) (silence, error) {
+	s := request.silence
+	s.Schedule = nil
+
+	if request.Duration != "" {
+		duration, err := time.ParseDuration(request.Duration)
+		if err != nil {
+			return silence{}, fmt.Errorf("invalid duration: %v", err)
+		}
+
+		start := s.StartsAt
+		if start.IsZero() {
+			start = now
+		}
+		s.EndsAt = start.Add(duration)
+	}
+
+	if s.StartsAt.IsZero() {
+		s.StartsAt = now
+	}
+
+	err := validateSilence(s)
+	if err != nil {
+		return silence{}, err
+	}
+
+	if !now.Before(s.EndsAt) {
+		return silence{}, errors.New("silence has already ended")
+	}
+
+	s.ID, err = newSilenceID()
+	if err != nil {
+		return silence{}, err
+	}
+
+	runtimeSilencesLock.Lock()
+	defer runtimeSilencesLock.Unlock()
+
+	runtimeSilences = append(runtimeSilences, s)
+	if err := saveSilences(now); err != nil {
+		log.Print("Error saving silences: ", err)
+	}
+
+	return s, nil
+}
+
+// Removes a silence created through the status API. Returns false if there
+// isn't one with the ID.
+func removeSilence(id string, now time.Time) bool {
+	runtimeSilencesLock.Lock()
+	defer runtimeSilencesLock.Unlock()
+
+	for i, s := range runtimeSilences {
+		if s.ID == id {
+			runtimeSilences = append(runtimeSilences[:i], runtimeSilences[i+1:]...)
+			if err := saveSilences(now); err != nil {
+				log.Print("Error saving silences: ", err)
+			}
+			return true
+		}
+	}
+
+	return false
+}
+
+func newSilenceID() (string, error) {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func buildSilenceStatus(now time.Time) []silenceStatus {
+	statuses := []silenceStatus{}
+
+	for _, s := range configuration.Silences {
+		statuses = append(statuses, silenceStatus{silence: s, Source: "config",
+			Active: s.isActive(now), Suppressed: suppressedCount(s.ID)})
+	}
+
+	runtimeSilencesLock.RLock()
+	defer runtimeSilencesLock.RUnlock()
+
+	for _, s := range runtimeSilences {
+		if !now.Before(s.EndsAt) {
+			continue
+		}
+		statuses = append(statuses, silenceStatus{silence: s, Source: "runtime",
+			Active: s.isActive(now), Suppressed: suppressedCount(s.ID)})
+	}
+
+	return statuses
+}
+
+// A silence can stop every notification, so creating or removing one needs
+// silence_api_token as a bearer token. Silences can't be changed through the
+// status API unless it is set. Writes the error response and returns false
+// if the request isn't allowed.
+func authorizeSilenceChange(w http.ResponseWriter, r *http.Request) bool {
+	if configuration.SilenceAPIToken == "" {
+		http.Error(w, "silences can only be changed when silence_api_token is set", http.StatusForbidden)
+		return false
+	}
+
+	authorization := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	if token == authorization ||
+		subtle.ConstantTimeCompare([]byte(token), []byte(configuration.SilenceAPIToken)) != 1 {
+
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "a valid silence_api_token is needed to change silences", http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+// GET lists silences, POST creates one
+func silencesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, buildSilenceStatus(time.Now()))
+
+	case "POST":
+		if !authorizeSilenceChange(w, r) {
+			return
+		}
+
+		var request silenceRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			http.Error(w, "invalid silence: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s, err := addSilence(request, time.Now())
+		if err != nil {
+			http.Error(w, "invalid silence: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		log.Printf("Silence %v created by %v until %v", s.ID, s.CreatedBy, s.EndsAt.Format(time.RFC3339))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, s)
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// DELETE /silences/{id} removes a silence created at runtime
+func silenceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !authorizeSilenceChange(w, r) {
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/silences/")
+	if !removeSilence(id, time.Now()) {
+		http.Error(w, "no runtime silence with id "+id, http.StatusNotFound)
+		return
+	}
+
+	log.Printf("Silence %v removed", id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,188 @@
+package elastic
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScheduledSilence(t *testing.T) {
+	s := silence{ClusterName: "prod", Schedule: &silenceSchedule{Days: []string{"sunday"}, Start: "02:00", End: "04:00"}}
+
+	// 2024-06-02 is a Sunday
+	if !s.isActive(time.Date(2024, 6, 2, 3, 0, 0, 0, time.UTC)) {
+		t.Fail()
+		t.Logf("Silence should be active during its window")
+	}
+
+	if s.isActive(time.Date(2024, 6, 2, 4, 0, 0, 0, time.UTC)) {
+		t.Fail()
+		t.Logf("Silence should end at the end of its window")
+	}
+
+	if s.isActive(time.Date(2024, 6, 3, 3, 0, 0, 0, time.UTC)) {
+		t.Fail()
+		t.Logf("Silence should only be active on its days")
+	}
+}
+
+func TestOvernightSilence(t *testing.T) {
+	s := silence{ClusterName: "prod", Schedule: &silenceSchedule{Days: []string{"sat"}, Start: "22:00", End: "02:00"}}
+
+	// 2024-06-01 is a Saturday
+	if !s.isActive(time.Date(2024, 6, 1, 23, 0, 0, 0, time.UTC)) {
+		t.Fail()
+		t.Logf("Silence should be active before midnight")
+	}
+
+	if !s.isActive(time.Date(2024, 6, 2, 1, 0, 0, 0, time.UTC)) {
+		t.Fail()
+		t.Logf("Silence should carry on past midnight into the next day")
+	}
+
+	if s.isActive(time.Date(2024, 6, 1, 1, 0, 0, 0, time.UTC)) {
+		t.Fail()
+		t.Logf("Silence should not be active the morning of its day")
+	}
+}
+
+func TestSilenceMatches(t *testing.T) {
+	s := silence{ClusterName: "prod-*", Severity: severityWarning}
+
+	if !s.matches(alertNotification{ClusterName: "prod-logs", Severity: severityWarning}) {
+		t.Fail()
+		t.Logf("Silence should match alerts matching all of its matchers")
+	}
+
+	if s.matches(alertNotification{ClusterName: "prod-logs", Severity: severityCritical}) {
+		t.Fail()
+		t.Logf("Silence should not match alerts with a different severity")
+	}
+
+	if s.matches(alertNotification{ClusterName: "staging", Severity: severityWarning}) {
+		t.Fail()
+		t.Logf("Silence should not match alerts from other clusters")
+	}
+}
+
+func TestValidateSilence(t *testing.T) {
+	invalid := []silence{
+		{ClusterName: "prod"},
+		{Schedule: &silenceSchedule{Start: "02:00", End: "04:00"}},
+		{ClusterName: "prod", Schedule: &silenceSchedule{Start: "2am", End: "04:00"}},
+		{ClusterName: "prod", Schedule: &silenceSchedule{Days: []string{"someday"}, Start: "02:00", End: "04:00"}},
+		{ClusterName: "prod", Schedule: &silenceSchedule{Start: "02:00", End: "04:00", Timezone: "Nowhere/Special"}},
+	}
+
+	for _, s := range invalid {
+		if validateSilence(s) == nil {
+			t.Fail()
+			t.Logf("Silence %+v should not be valid", s)
+		}
+	}
+}
+
+func TestRuntimeSilences(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "gwylio-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+
+	configuration.StateDirectory = stateDir
+	defer func() {
+		configuration.StateDirectory = ""
+		runtimeSilences = nil
+	}()
+
+	now := time.Now()
+	created, err := addSilence(silenceRequest{silence: silence{RuleName: "errors"}, Duration: "1h"}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alert := alertNotification{RuleName: "errors"}
+	if _, silenced := activeSilence(alert, now); !silenced {
+		t.Fail()
+		t.Logf("Alert should be silenced by the new silence")
+	}
+
+	runtimeSilences = nil
+	loadSilences()
+	if len(runtimeSilences) != 1 || runtimeSilences[0].ID != created.ID {
+		t.Fail()
+		t.Logf("Silence should be read back from the state directory, was %+v", runtimeSilences)
+	}
+
+	if !removeSilence(created.ID, now) {
+		t.Fail()
+		t.Logf("Silence should be removed")
+	}
+
+	if _, silenced := activeSilence(alert, now); silenced {
+		t.Fail()
+		t.Logf("Alert should not be silenced once the silence is removed")
+	}
+}
+
+func TestSilenceChangesNeedToken(t *testing.T) {
+	defer useTemporaryStateDirectory(t)()
+	defer func() {
+		configuration.SilenceAPIToken = ""
+		runtimeSilences = nil
+	}()
+
+	mux := http.NewServeMux()
+	registerStatusHandlers(mux)
+
+	post := func(token string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("POST", "/silences", strings.NewReader(body))
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	body := `{"cluster_name": "prod", "duration": "1h"}`
+
+	if recorder := post("", body); recorder.Code != http.StatusForbidden {
+		t.Fail()
+		t.Logf("Silences should not be changed without silence_api_token set, was %v", recorder.Code)
+	}
+
+	configuration.SilenceAPIToken = "s3cret"
+
+	if recorder := post("wrong", body); recorder.Code != http.StatusUnauthorized {
+		t.Fail()
+		t.Logf("Silences should not be changed with the wrong token, was %v", recorder.Code)
+	}
+
+	if recorder := post("s3cret", `{"duration": "1h"}`); recorder.Code != http.StatusBadRequest {
+		t.Fail()
+		t.Logf("A silence without matchers should be rejected, was %v", recorder.Code)
+	}
+
+	recorder := post("s3cret", body)
+	if recorder.Code != http.StatusCreated || recorder.Header().Get("Content-Type") != "application/json" {
+		t.Fail()
+		t.Logf("Silence should be created as json, was %v %v", recorder.Code, recorder.Header())
+	}
+
+	if len(runtimeSilences) != 1 {
+		t.Fatalf("One silence should have been created, was %+v", runtimeSilences)
+	}
+
+	request := httptest.NewRequest("DELETE", "/silences/"+runtimeSilences[0].ID, nil)
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnauthorized || len(runtimeSilences) != 1 {
+		t.Fail()
+		t.Logf("Silences should not be removed without the token, was %v", recorder.Code)
+	}
+}
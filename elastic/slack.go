@@ -0,0 +1,122 @@
+package elastic
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Colors Slack understands for an attachment's side bar
+const (
+	slackColorDanger  = "danger"
+	slackColorWarning = "warning"
+	slackColorGood    = "good"
+	slackColorInfo    = "#439FE0"
+)
+
+// How much of a search rule's hits are shown in a Slack attachment
+const (
+	slackHitPreviewCount  = 3
+	slackHitPreviewLength = 1000
+)
+
+type slackAttachmentField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+// Builds an attachment with the details of the alert, colored by how bad it is
+func buildSlackAttachment(alert alertNotification) slackAttachment {
+	attachment := slackAttachment{
+		FallbackText: alert.Message,
+		Color:        slackColor(alert),
+		Title:        slackTitle(alert),
+		TitleLink:    alert.KibanaURL,
+		Timestamp:    alert.Timestamp.Unix(),
+		MarkdownIn:   []string{"text"},
+	}
+
+	addField := func(title string, value string) {
+		if value != "" {
+			attachment.Fields = append(attachment.Fields, slackAttachmentField{title, value, true})
+		}
+	}
+
+	addField("Cluster", alert.ClusterName)
+	addField("Rule", alert.RuleName)
+	if alert.QueryKeyValue != "" {
+		// Titled with the query_key field, the measured value is under Result
+		queryKey := alert.QueryKey
+		if queryKey == "" {
+			queryKey = "Key"
+		}
+		addField(queryKey, alert.QueryKeyValue)
+	}
+	addField("Severity", alert.Severity)
+
+	if alert.Operator != "" {
+		addField("Result", formatAlertValue(alert.Value))
+		addField("Threshold", alert.Operator+" "+formatAlertValue(alert.Threshold))
+	}
+
+	if alert.Status == alertStateFiring && !alert.FiringSince.IsZero() {
+		addField("Since", alert.FiringSince.Format(time.RFC1123))
+	}
+
+	if preview := slackHitPreview(alert.Attachment); preview != "" {
+		attachment.Text = "```" + preview + "```"
+	}
+
+	return attachment
+}
+
+func slackColor(alert alertNotification) string {
+	if alert.Status == alertStateResolved {
+		return slackColorGood
+	}
+
+	switch alert.Severity {
+	case severityWarning:
+		return slackColorWarning
+	case severityInfo:
+		return slackColorInfo
+	}
+	return slackColorDanger
+}
+
+func slackTitle(alert alertNotification) string {
+	if alert.RuleName != "" {
+		return alert.RuleName
+	}
+	return "Cluster " + alert.ClusterName
+}
+
+func formatAlertValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// Returns the source of the first few hits, one per line, cut off if it
+// runs long
+func slackHitPreview(attachment []byte) string {
+	hits := parseTemplateHits(attachment, slackHitPreviewCount)
+	if len(hits) == 0 {
+		return ""
+	}
+
+	var lines []string
+	for _, hit := range hits {
+		line, err := json.Marshal(hit)
+		if err != nil {
+			continue
+		}
+		lines = append(lines, string(line))
+	}
+
+	preview := []rune(strings.Join(lines, "\n"))
+	if len(preview) > slackHitPreviewLength {
+		return string(preview[:slackHitPreviewLength]) + "..."
+	}
+	return string(preview)
+}
@@ -0,0 +1,111 @@
+package elastic
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildSlackAttachmentForRule(t *testing.T) {
+	alert := alertNotification{
+		Status:      alertStateFiring,
+		ClusterName: "my-cluster",
+		RuleName:    "Server errors",
+		Message:     "Too many server errors Result count was 150",
+		Value:       150,
+		Threshold:   100,
+		Operator:    ">",
+		Timestamp:   time.Now(),
+		FiringSince: time.Now(),
+		KibanaURL:   "https://kibana.example.com/app/discover",
+		Attachment:  []byte(`[{"_id":"1","_source":{"host":"web-1"}}]`),
+	}
+
+	attachment := buildSlackAttachment(alert)
+
+	if attachment.Color != slackColorDanger {
+		t.Fail()
+		t.Logf("A firing rule should be red, was %v", attachment.Color)
+	}
+
+	if attachment.Title != "Server errors" || attachment.TitleLink != alert.KibanaURL {
+		t.Fail()
+		t.Logf("Title should be the rule linked to kibana, was %v %v", attachment.Title, attachment.TitleLink)
+	}
+
+	fields := map[string]string{}
+	for _, field := range attachment.Fields {
+		fields[field.Title] = field.Value
+	}
+
+	if fields["Cluster"] != "my-cluster" || fields["Result"] != "150" || fields["Threshold"] != "> 100" {
+		t.Fail()
+		t.Logf("Fields are incorrect, was %v", fields)
+	}
+
+	if !strings.Contains(attachment.Text, `"host":"web-1"`) {
+		t.Fail()
+		t.Logf("Text should preview the hits, was %v", attachment.Text)
+	}
+
+	if attachment.FallbackText != alert.Message {
+		t.Fail()
+		t.Logf("Fallback text should be the plain message, was %v", attachment.FallbackText)
+	}
+
+	if _, ok := fields["Value"]; ok {
+		t.Fail()
+		t.Logf("A rule without a query_key should not have a Value field, was %v", fields)
+	}
+}
+
+func TestBuildSlackAttachmentForQueryKey(t *testing.T) {
+	alert := alertNotification{
+		Status:        alertStateFiring,
+		RuleName:      "Server errors",
+		QueryKey:      "host",
+		QueryKeyValue: "web-1",
+		Value:         150,
+		Threshold:     100,
+		Operator:      ">",
+	}
+
+	fields := map[string]string{}
+	for _, field := range buildSlackAttachment(alert).Fields {
+		fields[field.Title] = field.Value
+	}
+
+	if fields["host"] != "web-1" || fields["Result"] != "150" {
+		t.Fail()
+		t.Logf("The query_key value should be titled with its field, was %v", fields)
+	}
+}
+
+func TestBuildSlackAttachmentColors(t *testing.T) {
+	yellow := alertNotification{Status: alertStateFiring, ClusterName: "my-cluster", Severity: clusterStateSeverity("yellow")}
+	if buildSlackAttachment(yellow).Color != slackColorWarning {
+		t.Fail()
+		t.Logf("A yellow cluster should be a warning, was %v", buildSlackAttachment(yellow).Color)
+	}
+
+	if buildSlackAttachment(yellow).Title != "Cluster my-cluster" {
+		t.Fail()
+		t.Logf("Cluster alerts should be titled by cluster, was %v", buildSlackAttachment(yellow).Title)
+	}
+
+	resolved := alertNotification{Status: alertStateResolved, Severity: severityWarning}
+	if buildSlackAttachment(resolved).Color != slackColorGood {
+		t.Fail()
+		t.Logf("Resolved alerts should be green, was %v", buildSlackAttachment(resolved).Color)
+	}
+}
+
+func TestSlackHitPreviewTruncates(t *testing.T) {
+	hits := `[{"_id":"1","_source":{"message":"` + strings.Repeat("x", slackHitPreviewLength*2) + `"}}]`
+
+	preview := slackHitPreview([]byte(hits))
+	if len([]rune(preview)) != slackHitPreviewLength+3 || !strings.HasSuffix(preview, "...") {
+		t.Fail()
+		t.Logf("Preview should be cut off at %v characters, was %v", slackHitPreviewLength, len(preview))
+	}
+}
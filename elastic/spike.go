@@ -0,0 +1,153 @@
+package elastic
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	spikeReferencePrevious = "previous"
+	spikeReferenceLastWeek = "last_week"
+
+	spikeComparisonRatio      = "ratio"
+	spikeComparisonDifference = "difference"
+
+	defaultTimestampField = "timestamp"
+)
+
+// A time range in Elasticsearch date math, from inclusive and to exclusive
+type timeWindow struct {
+	From string
+	To   string
+}
+
+func validateSpikeRule(rule notificationRule) error {
+	if rule.SpikeTimeframe <= 0 {
+		return errors.New("spike_timeframe must be greater than 0")
+	}
+
+	switch rule.SpikeReference {
+	case "", spikeReferencePrevious, spikeReferenceLastWeek:
+	default:
+		return fmt.Errorf("unknown spike_reference %v", rule.SpikeReference)
+	}
+
+	switch rule.SpikeComparison {
+	case "", spikeComparisonRatio, spikeComparisonDifference:
+	default:
+		return fmt.Errorf("unknown spike_comparison %v", rule.SpikeComparison)
+	}
+
+	return nil
+}
+
+// Counts the documents in the current and reference windows and compares them
+func evaluateSpikeRule(rule *notificationRule, hosts []string, ruleURL string) (ruleResult, error) {
+	current, reference := spikeWindows(rule.SpikeTimeframe, rule.SpikeReference)
+
+	currentCount, err := countInWindow(rule, hosts, ruleURL, current)
+	if err != nil {
+		return ruleResult{}, err
+	}
+
+	referenceCount, err := countInWindow(rule, hosts, ruleURL, reference)
+	if err != nil {
+		return ruleResult{}, err
+	}
+
+	comparison := rule.SpikeComparison
+	if comparison == "" {
+		comparison = spikeComparisonRatio
+	}
+
+	value := compareSpike(comparison, currentCount, referenceCount)
+
+	return ruleResult{
+		Value: value,
+		Description: fmt.Sprintf("Current count was %v, reference count was %v, %v was %v",
+			currentCount, referenceCount, comparison, formatSpikeValue(value)),
+	}, nil
+}
+
+func countInWindow(rule *notificationRule, hosts []string, ruleURL string, window timeWindow) (int, error) {
+	timestampField := rule.TimestampField
+	if timestampField == "" {
+		timestampField = defaultTimestampField
+	}
+
+	query, err := buildWindowQuery(rule.Query, timestampField, window)
+	if err != nil {
+		return -1, err
+	}
+
+	body, err := failoverHTTPRequest(hosts, "POST", ruleURL, bytes.NewBuffer(query))
+	if err != nil {
+		return -1, err
+	}
+
+	return parseCountQuery(body)
+}
+
+// The current window ends now. The reference window is either the one
+// right before it or the same time a week ago.
+func spikeWindows(timeframe int, reference string) (timeWindow, timeWindow) {
+	current := timeWindow{From: fmt.Sprintf("now-%vm", timeframe), To: "now"}
+
+	if reference == spikeReferenceLastWeek {
+		return current, timeWindow{From: fmt.Sprintf("now-7d-%vm", timeframe), To: "now-7d"}
+	}
+
+	return current, timeWindow{From: fmt.Sprintf("now-%vm", timeframe*2), To: current.From}
+}
+
+// Limits the rule's query to a time window
+func buildWindowQuery(query json.RawMessage, timestampField string, window timeWindow) ([]byte, error) {
+	body := map[string]json.RawMessage{}
+	if len(query) > 0 {
+		err := json.Unmarshal(query, &body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rangeFilter := map[string]interface{}{
+		"range": map[string]interface{}{
+			timestampField: map[string]string{"gte": window.From, "lt": window.To},
+		},
+	}
+
+	filters := []interface{}{rangeFilter}
+	if ruleQuery, ok := body["query"]; ok {
+		filters = append(filters, ruleQuery)
+	}
+
+	windowQuery, err := json.Marshal(map[string]interface{}{
+		"bool": map[string]interface{}{"filter": filters},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	body["query"] = windowQuery
+
+	return json.Marshal(body)
+}
+
+// An empty reference window is treated as a count of one so a ratio can
+// still be worked out
+func compareSpike(comparison string, current int, reference int) float64 {
+	if comparison == spikeComparisonDifference {
+		return float64(current - reference)
+	}
+
+	if reference == 0 {
+		return float64(current)
+	}
+	return float64(current) / float64(reference)
+}
+
+func formatSpikeValue(value float64) string {
+	return fmt.Sprintf("%.2f", value)
+}
@@ -0,0 +1,83 @@
+package elastic
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSpikeWindows(t *testing.T) {
+	current, reference := spikeWindows(15, spikeReferencePrevious)
+
+	if current.From != "now-15m" || current.To != "now" {
+		t.Fail()
+		t.Logf("Current window is incorrect, was %v", current)
+	}
+
+	if reference.From != "now-30m" || reference.To != "now-15m" {
+		t.Fail()
+		t.Logf("Previous reference window is incorrect, was %v", reference)
+	}
+
+	_, reference = spikeWindows(15, spikeReferenceLastWeek)
+	if reference.From != "now-7d-15m" || reference.To != "now-7d" {
+		t.Fail()
+		t.Logf("Last week reference window is incorrect, was %v", reference)
+	}
+}
+
+func TestBuildWindowQuery(t *testing.T) {
+	query := json.RawMessage(`{"query":{"term":{"level":"error"}}}`)
+
+	body, err := buildWindowQuery(query, "@timestamp", timeWindow{"now-15m", "now"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"query":{"bool":{"filter":[{"range":{"@timestamp":{"gte":"now-15m","lt":"now"}}},{"term":{"level":"error"}}]}}}`
+	if string(body) != expected {
+		t.Fail()
+		t.Logf("Window query is incorrect. Should be %v, was %v", expected, string(body))
+	}
+}
+
+func TestCompareSpike(t *testing.T) {
+	tests := []struct {
+		comparison string
+		current    int
+		reference  int
+		expected   float64
+	}{
+		{spikeComparisonRatio, 300, 100, 3},
+		{spikeComparisonRatio, 20, 100, 0.2},
+		{spikeComparisonRatio, 5, 0, 5},
+		{spikeComparisonDifference, 80, 100, -20},
+	}
+
+	for _, test := range tests {
+		value := compareSpike(test.comparison, test.current, test.reference)
+		if value != test.expected {
+			t.Fail()
+			t.Logf("%v of %v and %v should be %v, was %v", test.comparison, test.current, test.reference, test.expected, value)
+		}
+	}
+}
+
+func TestValidateSpikeRule(t *testing.T) {
+	if err := validateSpikeRule(notificationRule{SpikeTimeframe: 10}); err != nil {
+		t.Fail()
+		t.Logf("Spike rule with defaults should be valid: %v", err)
+	}
+
+	invalidRules := []notificationRule{
+		{},
+		{SpikeTimeframe: 10, SpikeReference: "yesterday"},
+		{SpikeTimeframe: 10, SpikeComparison: "percent"},
+	}
+
+	for _, rule := range invalidRules {
+		if validateSpikeRule(rule) == nil {
+			t.Fail()
+			t.Logf("Spike rule should not be valid: %+v", rule)
+		}
+	}
+}
@@ -0,0 +1,512 @@
+package elastic
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultSpoolDirectory = "spool"
+	defaultSpoolMaxBytes  = 1024 * 1024 * 1024
+	defaultSpoolMaxAge    = 72
+	spoolSegmentMaxBytes  = 16 * 1024 * 1024
+	spoolSegmentExtension = ".spool"
+
+	// Added to a segment's path for the file that records how many of its
+	// documents have been replayed
+	spoolProgressExtension = ".replayed"
+)
+
+var indexSpool *diskSpool
+
+// Counters for documents that could not be sent straight to elastic_clients_to
+var indexQueueStats struct {
+	Spooled  uint64
+	Replayed uint64
+	Dropped  uint64
+}
+
+// Set while elastic_clients_to can't be reached, so new documents go
+// to the spool behind the ones already waiting there
+var targetUnreachable int32
+
+// A directory of segment files holding documents waiting to be indexed.
+// Each record in a segment is a length, a crc32 checksum and the json
+// encoded indexQueueItem. Segments are replayed oldest first.
+type diskSpool struct {
+	sync.Mutex
+	directory   string
+	maxBytes    int64
+	maxAge      time.Duration
+	current     *os.File
+	currentPath string
+	currentSize int64
+	nextSegment uint64
+
+	// Segment being replayed, which isn't dropped by enforceLimits while
+	// its documents are being sent
+	replaying string
+}
+
+type spoolStats struct {
+	Spooled  uint64
+	Replayed uint64
+	Dropped  uint64
+	Segments int
+	Bytes    int64
+}
+
+func openSpool(directory string, maxBytes int64, maxAge time.Duration) (*diskSpool, error) {
+	err := os.MkdirAll(directory, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	spool := &diskSpool{directory: directory, maxBytes: maxBytes, maxAge: maxAge}
+
+	segments, err := spool.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, segment := range segments {
+		sequence := segmentSequence(segment)
+		if sequence >= spool.nextSegment {
+			spool.nextSegment = sequence + 1
+		}
+	}
+
+	return spool, nil
+}
+
+// Appends the items to the current segment, starting a new one when it gets too big
+func (spool *diskSpool) write(items []indexQueueItem) error {
+	spool.Lock()
+	defer spool.Unlock()
+
+	for _, item := range items {
+		if spool.current == nil || spool.currentSize >= spoolSegmentMaxBytes {
+			err := spool.rotate()
+			if err != nil {
+				return err
+			}
+		}
+
+		written, err := writeSpoolRecord(spool.current, item)
+		spool.currentSize += int64(written)
+		if err != nil {
+			return err
+		}
+
+		atomic.AddUint64(&indexQueueStats.Spooled, 1)
+	}
+
+	spool.enforceLimits()
+
+	return nil
+}
+
+// Returns true if there is anything waiting in the spool
+func (spool *diskSpool) pending() bool {
+	spool.Lock()
+	defer spool.Unlock()
+
+	segments, err := spool.segments()
+	if err != nil {
+		log.Print("Error reading spool directory: ", err)
+		return false
+	}
+
+	if len(segments) == 1 && segments[0] == spool.currentPath && spool.currentSize == 0 {
+		return false
+	}
+
+	return len(segments) > 0
+}
+
+// Returns the path, items and number of corrupt records of the oldest segment,
+// and marks it as being replayed until it is removed or stopReplaying is
+// called. If the only segment is the one being written to, it is closed first
+// so new writes go to a new segment.
+func (spool *diskSpool) oldestSegment() (string, []indexQueueItem, int, error) {
+	spool.Lock()
+	defer spool.Unlock()
+
+	segments, err := spool.segments()
+	if err != nil || len(segments) == 0 {
+		return "", nil, 0, err
+	}
+
+	oldest := segments[0]
+	if oldest == spool.currentPath {
+		spool.closeCurrent()
+	}
+
+	spool.replaying = oldest
+	items, corrupt, err := readSpoolSegment(oldest)
+	return oldest, items, corrupt, err
+}
+
+// Lets enforceLimits drop the segment being replayed again, after a replay
+// that didn't finish
+func (spool *diskSpool) stopReplaying() {
+	spool.Lock()
+	defer spool.Unlock()
+
+	spool.replaying = ""
+}
+
+func (spool *diskSpool) remove(segment string) {
+	spool.Lock()
+	defer spool.Unlock()
+
+	if segment == spool.replaying {
+		spool.replaying = ""
+	}
+
+	err := os.Remove(segment)
+	if err != nil {
+		log.Print("Error removing spool segment: ", err)
+	}
+	os.Remove(segment + spoolProgressExtension)
+}
+
+// Returns how many documents at the start of the segment have been replayed
+func (spool *diskSpool) replayedCount(segment string) int {
+	contents, err := ioutil.ReadFile(segment + spoolProgressExtension)
+	if err != nil {
+		return 0
+	}
+
+	count, _ := strconv.Atoi(strings.TrimSpace(string(contents)))
+	return count
+}
+
+// Records how many documents at the start of the segment have been replayed,
+// so they aren't sent again if replaying the rest of it fails
+func (spool *diskSpool) recordReplayed(segment string, count int) {
+	err := ioutil.WriteFile(segment+spoolProgressExtension, []byte(strconv.Itoa(count)), 0644)
+	if err != nil {
+		log.Print("Error recording spool replay progress: ", err)
+	}
+}
+
+func (spool *diskSpool) stats() spoolStats {
+	spool.Lock()
+	defer spool.Unlock()
+
+	stats := spoolStats{
+		Spooled:  atomic.LoadUint64(&indexQueueStats.Spooled),
+		Replayed: atomic.LoadUint64(&indexQueueStats.Replayed),
+		Dropped:  atomic.LoadUint64(&indexQueueStats.Dropped),
+	}
+
+	segments, _ := spool.segments()
+	for _, segment := range segments {
+		if info, err := os.Stat(segment); err == nil {
+			stats.Segments++
+			stats.Bytes += info.Size()
+		}
+	}
+
+	return stats
+}
+
+// Removes the oldest closed segments when the spool is over its size limit or
+// they are older than the max age. The segment being replayed is skipped, it
+// is removed once its documents have been sent. Must be called with the lock held.
+func (spool *diskSpool) enforceLimits() {
+	segments, err := spool.segments()
+	if err != nil {
+		log.Print("Error reading spool directory: ", err)
+		return
+	}
+
+	var totalBytes int64
+	sizes := make([]int64, len(segments))
+	for i, segment := range segments {
+		if info, err := os.Stat(segment); err == nil {
+			sizes[i] = info.Size()
+			totalBytes += info.Size()
+		}
+	}
+
+	for i, segment := range segments {
+		if segment == spool.currentPath {
+			break
+		}
+
+		if segment == spool.replaying {
+			continue
+		}
+
+		info, err := os.Stat(segment)
+		if err != nil {
+			continue
+		}
+
+		tooOld := spool.maxAge > 0 && info.ModTime().Before(time.Now().Add(spool.maxAge*-1))
+		tooBig := spool.maxBytes > 0 && totalBytes > spool.maxBytes
+		if !tooOld && !tooBig {
+			break
+		}
+
+		items, corrupt, _ := readSpoolSegment(segment)
+		dropped := len(items) - spool.replayedCount(segment)
+		if dropped < 0 {
+			dropped = 0
+		}
+		dropped += corrupt
+		atomic.AddUint64(&indexQueueStats.Dropped, uint64(dropped))
+		log.Printf("Dropping spool segment %v with %v documents", segment, dropped)
+
+		os.Remove(segment)
+		os.Remove(segment + spoolProgressExtension)
+		totalBytes -= sizes[i]
+	}
+}
+
+// Closes the current segment and opens the next one. Must be called with the lock held.
+func (spool *diskSpool) rotate() error {
+	spool.closeCurrent()
+
+	segmentPath := filepath.Join(spool.directory,
+		fmt.Sprintf("%020d%v", spool.nextSegment, spoolSegmentExtension))
+
+	file, err := os.OpenFile(segmentPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	spool.nextSegment++
+	spool.current = file
+	spool.currentPath = segmentPath
+	spool.currentSize = 0
+
+	return nil
+}
+
+func (spool *diskSpool) closeCurrent() {
+	if spool.current != nil {
+		spool.current.Close()
+	}
+	spool.current = nil
+	spool.currentPath = ""
+	spool.currentSize = 0
+}
+
+// Lists the segment files oldest first
+func (spool *diskSpool) segments() ([]string, error) {
+	files, err := ioutil.ReadDir(spool.directory)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []string
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), spoolSegmentExtension) {
+			segments = append(segments, filepath.Join(spool.directory, file.Name()))
+		}
+	}
+
+	sort.Strings(segments)
+	return segments, nil
+}
+
+func segmentSequence(segment string) uint64 {
+	name := strings.TrimSuffix(filepath.Base(segment), spoolSegmentExtension)
+	sequence, _ := strconv.ParseUint(name, 10, 64)
+	return sequence
+}
+
+func writeSpoolRecord(writer io.Writer, item indexQueueItem) (int, error) {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return 0, err
+	}
+
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(data))
+
+	written, err := writer.Write(append(header, data...))
+	return written, err
+}
+
+// Reads every record in a segment and returns them with the number of corrupt
+// records. A record that fails its checksum is skipped and reading carries on
+// with the next one. Reading stops at a truncated record.
+func readSpoolSegment(segment string) ([]indexQueueItem, int, error) {
+	file, err := os.Open(segment)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, 8)
+
+	var items []indexQueueItem
+	corrupt := 0
+	for {
+		_, err = io.ReadFull(reader, header)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return items, corrupt + 1, fmt.Errorf("truncated record header in %v", segment)
+		}
+
+		data := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+		_, err = io.ReadFull(reader, data)
+		if err != nil {
+			return items, corrupt + 1, fmt.Errorf("truncated record in %v", segment)
+		}
+
+		var item indexQueueItem
+		if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) || json.Unmarshal(data, &item) != nil {
+			corrupt++
+			continue
+		}
+
+		items = append(items, item)
+	}
+
+	if corrupt > 0 {
+		return items, corrupt, fmt.Errorf("%v corrupt records in %v", corrupt, segment)
+	}
+	return items, 0, nil
+}
+
+func startSpool() {
+	openIndexSpool()
+	go replaySpool()
+}
+
+func openIndexSpool() {
+	maxBytes := int64(defaultSpoolMaxBytes)
+	if configuration.SpoolMaxBytes > 0 {
+		maxBytes = configuration.SpoolMaxBytes
+	}
+
+	maxAge := defaultSpoolMaxAge
+	if configuration.SpoolMaxAge > 0 {
+		maxAge = configuration.SpoolMaxAge
+	}
+
+	directory := defaultSpoolDirectory
+	if configuration.SpoolDirectory != "" {
+		directory = configuration.SpoolDirectory
+	}
+
+	var err error
+	indexSpool, err = openSpool(directory, maxBytes, time.Hour*time.Duration(maxAge))
+	if err != nil {
+		log.Fatal("Error opening spool directory: ", err)
+	}
+
+	// Anything left from the last run goes out before new documents
+	if indexSpool.pending() {
+		log.Print("Found spooled documents from a previous run")
+		atomic.StoreInt32(&targetUnreachable, 1)
+	}
+}
+
+// Sends spooled documents, oldest first, once elastic_clients_to is reachable again
+func replaySpool() {
+	for {
+		if !indexSpool.pending() {
+			if atomic.CompareAndSwapInt32(&targetUnreachable, 1, 0) {
+				stats := indexSpool.stats()
+				log.Printf("Spool replay complete. Spooled: %v Replayed: %v Dropped: %v",
+					stats.Spooled, stats.Replayed, stats.Dropped)
+			}
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		if !replayOldestSegment() {
+			time.Sleep(30 * time.Second)
+		}
+	}
+}
+
+// Sends the oldest spool segment to the target cluster and removes it.
+// Corrupt records in it are counted as dropped. Returns false if the target
+// couldn't be reached.
+func replayOldestSegment() bool {
+	segment, items, corrupt, err := indexSpool.oldestSegment()
+	if err != nil {
+		log.Print("Error reading spool segment: ", err)
+	}
+
+	if segment == "" {
+		return true
+	}
+
+	if !replayItems(segment, items) {
+		indexSpool.stopReplaying()
+		return false
+	}
+
+	if corrupt > 0 {
+		atomic.AddUint64(&indexQueueStats.Dropped, uint64(corrupt))
+		log.Printf("Dropped %v corrupt records from spool segment %v", corrupt, segment)
+	}
+
+	indexSpool.remove(segment)
+	return true
+}
+
+// Sends the segment's documents in batches, starting after the ones already
+// replayed. Progress is recorded after each batch, so when one fails the
+// batches before it aren't sent again and duplicated.
+func replayItems(segment string, items []indexQueueItem) bool {
+	for start := indexSpool.replayedCount(segment); start < len(items); start += bulkMaxDocs() {
+		end := start + bulkMaxDocs()
+		if end > len(items) {
+			end = len(items)
+		}
+
+		failed, err := sendBulkBatch(items[start:end])
+		if err != nil {
+			return false
+		}
+
+		if len(failed) > 0 {
+			spoolItems(failed)
+		}
+
+		atomic.AddUint64(&indexQueueStats.Replayed, uint64(end-start))
+		indexSpool.recordReplayed(segment, end)
+	}
+
+	return true
+}
+
+func spoolItems(items []indexQueueItem) {
+	if indexSpool == nil {
+		atomic.AddUint64(&indexQueueStats.Dropped, uint64(len(items)))
+		return
+	}
+
+	err := indexSpool.write(items)
+	if err != nil {
+		log.Print("Error writing to spool: ", err)
+		atomic.AddUint64(&indexQueueStats.Dropped, uint64(len(items)))
+	}
+}
@@ -0,0 +1,264 @@
+package elastic
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSpoolReplaysInOrder(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "gwylio-spool")
+	defer os.RemoveAll(directory)
+
+	spool, err := openSpool(directory, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spool.write([]indexQueueItem{{".gwylio-2016.08.04", "jvm_stats", `{"node_name":"node-1"}`}})
+	spool.write([]indexQueueItem{{".gwylio-2016.08.04", "jvm_stats", `{"node_name":"node-2"}`}})
+
+	if !spool.pending() {
+		t.Fail()
+		t.Logf("Spool should have pending documents")
+	}
+
+	segment, items, _, err := spool.oldestSegment()
+	if err != nil {
+		t.Fail()
+		t.Log(err)
+	}
+
+	if len(items) != 2 {
+		t.Fatalf("Spool should have returned 2 documents, returned %v", len(items))
+	}
+
+	if items[0].Payload != `{"node_name":"node-1"}` || items[1].Payload != `{"node_name":"node-2"}` {
+		t.Fail()
+		t.Logf("Spooled documents were returned out of order")
+	}
+
+	spool.remove(segment)
+
+	if spool.pending() {
+		t.Fail()
+		t.Logf("Spool should be empty after the segment is removed")
+	}
+}
+
+func TestSpoolDetectsCorruptRecords(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "gwylio-spool")
+	defer os.RemoveAll(directory)
+
+	spool, _ := openSpool(directory, 0, 0)
+	spool.write([]indexQueueItem{
+		{".gwylio-2016.08.04", "jvm_stats", `{"node_name":"node-1"}`},
+		{".gwylio-2016.08.04", "jvm_stats", `{"node_name":"node-2"}`},
+		{".gwylio-2016.08.04", "jvm_stats", `{"node_name":"node-3"}`},
+	})
+	segmentPath := spool.currentPath
+	spool.closeCurrent()
+
+	data, _ := ioutil.ReadFile(segmentPath)
+	// Flip a byte in the payload of the second record
+	recordLength := len(data) / 3
+	data[recordLength+recordLength/2] ^= 0xff
+	ioutil.WriteFile(segmentPath, data, 0644)
+
+	items, corrupt, err := readSpoolSegment(segmentPath)
+	if err == nil {
+		t.Fail()
+		t.Logf("Reading a corrupt segment should return an error")
+	}
+
+	if len(items) != 2 || corrupt != 1 || items[1].Payload != `{"node_name":"node-3"}` {
+		t.Fail()
+		t.Logf("Records around the corrupt one should be returned, returned %v with %v corrupt", items, corrupt)
+	}
+}
+
+func TestSpoolReplayCountsCorruptRecords(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "gwylio-spool")
+	defer os.RemoveAll(directory)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_bulk" {
+			w.Write([]byte(`{"version":{"number":"7.10.0"}}`))
+			return
+		}
+		w.Write([]byte(`{"errors":false,"items":[{"index":{"status":201}}]}`))
+	}))
+	defer server.Close()
+
+	configuration.ElasticClientsTo = []string{server.URL}
+	configureHostClients()
+	indexSpool, _ = openSpool(directory, 0, 0)
+	defer func() {
+		configuration.ElasticClientsTo = nil
+		indexSpool = nil
+		clusterVersionsLock.Lock()
+		delete(clusterVersions, targetClusterKey)
+		clusterVersionsLock.Unlock()
+	}()
+
+	indexSpool.write([]indexQueueItem{
+		{".gwylio-2016.08.04", "jvm_stats", `{"node_name":"node-1"}`},
+		{".gwylio-2016.08.04", "jvm_stats", `{"node_name":"node-2"}`},
+	})
+	segmentPath := indexSpool.currentPath
+
+	// Cut the last record short, as a crash part way through a write would
+	data, _ := ioutil.ReadFile(segmentPath)
+	ioutil.WriteFile(segmentPath, data[:len(data)-3], 0644)
+
+	droppedBefore := atomic.LoadUint64(&indexQueueStats.Dropped)
+	if !replayOldestSegment() {
+		t.Fatal("Replay should finish once the target responds")
+	}
+
+	if dropped := atomic.LoadUint64(&indexQueueStats.Dropped) - droppedBefore; dropped != 1 {
+		t.Fail()
+		t.Logf("The corrupt record should be counted as dropped, %v were", dropped)
+	}
+}
+
+func TestSpoolLimitsSkipSegmentBeingReplayed(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "gwylio-spool")
+	defer os.RemoveAll(directory)
+
+	spool, _ := openSpool(directory, 0, time.Hour)
+	spool.write([]indexQueueItem{{".gwylio-2016.08.04", "jvm_stats", `{"node_name":"node-1"}`}})
+
+	segment, _, _, _ := spool.oldestSegment()
+	twoHoursAgo := time.Now().Add(time.Hour * -2)
+	os.Chtimes(segment, twoHoursAgo, twoHoursAgo)
+
+	spool.write([]indexQueueItem{{".gwylio-2016.08.04", "jvm_stats", `{"node_name":"node-2"}`}})
+
+	if _, err := os.Stat(segment); err != nil {
+		t.Fail()
+		t.Logf("The segment being replayed should not be dropped, was %v", err)
+	}
+
+	spool.stopReplaying()
+	spool.write([]indexQueueItem{{".gwylio-2016.08.04", "jvm_stats", `{"node_name":"node-3"}`}})
+
+	if _, err := os.Stat(segment); !os.IsNotExist(err) {
+		t.Fail()
+		t.Logf("The segment should be dropped once it isn't being replayed")
+	}
+}
+
+func TestSpoolDropsOldSegments(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "gwylio-spool")
+	defer os.RemoveAll(directory)
+
+	spool, _ := openSpool(directory, 0, time.Hour)
+	spool.write([]indexQueueItem{{".gwylio-2016.08.04", "jvm_stats", `{"node_name":"node-1"}`}})
+	oldSegment := spool.currentPath
+	spool.Lock()
+	spool.rotate()
+	spool.Unlock()
+
+	twoHoursAgo := time.Now().Add(time.Hour * -2)
+	os.Chtimes(oldSegment, twoHoursAgo, twoHoursAgo)
+
+	droppedBefore := indexQueueStats.Dropped
+	spool.write([]indexQueueItem{{".gwylio-2016.08.04", "jvm_stats", `{"node_name":"node-2"}`}})
+
+	if _, err := os.Stat(oldSegment); !os.IsNotExist(err) {
+		t.Fail()
+		t.Logf("Segment older than the max age should have been removed")
+	}
+
+	if indexQueueStats.Dropped != droppedBefore+1 {
+		t.Fail()
+		t.Logf("Dropped count should have increased by 1, was %v", indexQueueStats.Dropped-droppedBefore)
+	}
+}
+
+func TestSpoolReplayDoesNotResendBatches(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "gwylio-spool")
+	defer os.RemoveAll(directory)
+
+	var indexed []string
+	failBulk := true
+	bulkRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_bulk" {
+			w.Write([]byte(`{"version":{"number":"7.10.0"}}`))
+			return
+		}
+
+		bulkRequests++
+		if failBulk && bulkRequests == 2 {
+			w.Write([]byte("<html>Bad Gateway</html>"))
+			return
+		}
+
+		var items []string
+		scanner := bufio.NewScanner(r.Body)
+		for line := 0; scanner.Scan(); line++ {
+			if line%2 == 1 {
+				indexed = append(indexed, scanner.Text())
+				items = append(items, `{"index":{"status":201}}`)
+			}
+		}
+		w.Write([]byte(`{"errors":false,"items":[` + strings.Join(items, ",") + `]}`))
+	}))
+	defer server.Close()
+
+	configuration.ElasticClientsTo = []string{server.URL}
+	configuration.BulkMaxDocs = 1
+	configureHostClients()
+	indexSpool, _ = openSpool(directory, 0, 0)
+	defer func() {
+		configuration.ElasticClientsTo = nil
+		configuration.BulkMaxDocs = 0
+		indexSpool = nil
+		atomic.StoreInt32(&targetUnreachable, 0)
+		clusterVersionsLock.Lock()
+		delete(clusterVersions, targetClusterKey)
+		clusterVersionsLock.Unlock()
+	}()
+
+	indexSpool.write([]indexQueueItem{
+		{".gwylio-2016.08.04", "jvm_stats", `{"node_name":"node-1"}`},
+		{".gwylio-2016.08.04", "jvm_stats", `{"node_name":"node-2"}`},
+		{".gwylio-2016.08.04", "jvm_stats", `{"node_name":"node-3"}`},
+	})
+
+	if replayOldestSegment() {
+		t.Fail()
+		t.Logf("Replay should stop when a bulk response can't be parsed")
+	}
+
+	failBulk = false
+	if !replayOldestSegment() {
+		t.Fatal("Replay should finish once the target responds")
+	}
+
+	if len(indexed) != 3 || !strings.Contains(indexed[0], "node-1") || !strings.Contains(indexed[2], "node-3") {
+		t.Fail()
+		t.Logf("Each document should be indexed once, in order, was %v", indexed)
+	}
+
+	if indexSpool.pending() {
+		t.Fail()
+		t.Logf("Spool should be empty once the segment is replayed")
+	}
+
+	failBulk, bulkRequests = true, 1
+	flushBulkBatch([]indexQueueItem{{".gwylio-2016.08.04", "jvm_stats", `{"node_name":"node-4"}`}})
+
+	if !indexSpool.pending() {
+		t.Fail()
+		t.Logf("A batch whose response can't be parsed should be spooled")
+	}
+}
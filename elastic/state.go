@@ -0,0 +1,61 @@
+package elastic
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// Where state that should survive a restart is kept when state_directory isn't set
+const defaultStateDirectory = "state"
+
+var unsafeFileNameCharacters = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+func stateDirectory() string {
+	if configuration.StateDirectory != "" {
+		return configuration.StateDirectory
+	}
+	return defaultStateDirectory
+}
+
+// Returns the path of a state file, with name made safe to use as a file name
+func statePath(folder string, name string) string {
+	return filepath.Join(stateDirectory(), folder, unsafeFileNameCharacters.ReplaceAllString(name, "_")+".json")
+}
+
+// Reads a state file into value. Returns false if the file doesn't exist.
+func loadStateFile(path string, value interface{}) (bool, error) {
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, json.Unmarshal(contents, value)
+}
+
+// Writes value to a state file. The file is written beside the old one and
+// renamed over it, so a crash never leaves a partial file.
+func saveStateFile(path string, value interface{}) error {
+	contents, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	temporaryPath := path + ".tmp"
+	err = ioutil.WriteFile(temporaryPath, contents, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(temporaryPath, path)
+}
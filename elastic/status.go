@@ -0,0 +1,224 @@
+package elastic
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// /healthz fails if a collection cycle hasn't finished in this many collect intervals
+const healthzStaleIntervals = 3
+
+// When the last collection cycle finished, in unix nanoseconds
+var lastMonitorCycle int64
+
+type clusterStatus struct {
+	ClusterName                      string     `json:"cluster_name"`
+	Hosts                            []string   `json:"hosts"`
+	Version                          string     `json:"version"`
+	ClusterState                     string     `json:"cluster_state"`
+	NumberOfNodes                    int        `json:"number_of_nodes"`
+	ExpectedNodeCount                int        `json:"expected_node_count"`
+	LastGoodNodeCountDate            time.Time  `json:"last_good_node_count_date"`
+	LastGoodClusterStatusDate        time.Time  `json:"last_good_cluster_status_date"`
+	LastNodeCountNotificationTime    time.Time  `json:"last_node_count_notification_time"`
+	LastClusterStateNotificationDate time.Time  `json:"last_cluster_state_notification_date"`
+	NodeCountAlert                   alertState `json:"node_count_alert"`
+	ClusterStateAlert                alertState `json:"cluster_state_alert"`
+	LastCollectionStart              time.Time  `json:"last_collection_start"`
+	LastCollectionDuration           string     `json:"last_collection_duration"`
+	LastCollectionErrors             []string   `json:"last_collection_errors"`
+}
+
+type ruleStatus struct {
+	Name                   string                   `json:"rule_name"`
+	Type                   string                   `json:"rule_type"`
+	Severity               string                   `json:"severity"`
+	ClusterName            string                   `json:"cluster_name"`
+	Enabled                bool                     `json:"enabled"`
+	LastProcessedTime      time.Time                `json:"last_processed_time"`
+	LastNotificationSent   time.Time                `json:"last_notification_sent"`
+	Alert                  alertState               `json:"alert"`
+	ConsecutiveQueryErrors int                      `json:"consecutive_query_errors"`
+	LastQueryError         string                   `json:"last_query_error"`
+	QueryErrorAlert        alertState               `json:"query_error_alert"`
+	QueryKeyAlerts         map[string]queryKeyAlert `json:"query_key_alerts,omitempty"`
+}
+
+type queueStatus struct {
+	Depth         int    `json:"depth"`
+	Capacity      int    `json:"capacity"`
+	Unreachable   bool   `json:"target_unreachable"`
+	Spooled       uint64 `json:"spooled"`
+	Replayed      uint64 `json:"replayed"`
+	Dropped       uint64 `json:"dropped"`
+	SpoolSegments int    `json:"spool_segments"`
+	SpoolBytes    int64  `json:"spool_bytes"`
+}
+
+// Starts the metrics and status listeners. If both use the same
+// address they are served by the same listener.
+func startHTTPListeners() {
+	muxes := map[string]*http.ServeMux{}
+
+	if configuration.MetricsListenAddress != "" {
+		muxes[configuration.MetricsListenAddress] = http.NewServeMux()
+		registerMetricsHandlers(muxes[configuration.MetricsListenAddress])
+	}
+
+	if configuration.StatusListenAddress != "" {
+		if _, ok := muxes[configuration.StatusListenAddress]; !ok {
+			muxes[configuration.StatusListenAddress] = http.NewServeMux()
+		}
+		registerStatusHandlers(muxes[configuration.StatusListenAddress])
+	}
+
+	for address, mux := range muxes {
+		go func(address string, mux *http.ServeMux) {
+			log.Print("Listening on ", address)
+			err := http.ListenAndServe(address, mux)
+			if err != nil {
+				log.Print("Error listening on ", address, ": ", err)
+			}
+		}(address, mux)
+	}
+}
+
+func registerStatusHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/status/clusters", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, buildClusterStatus())
+	})
+	mux.HandleFunc("/status/rules", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, buildRuleStatus())
+	})
+	mux.HandleFunc("/status/queue", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, buildQueueStatus())
+	})
+	mux.HandleFunc("/silences", silencesHandler)
+	mux.HandleFunc("/silences/", silenceHandler)
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	lastCycle := atomic.LoadInt64(&lastMonitorCycle)
+	staleAfter := time.Second * time.Duration(configuration.CollectInterval*healthzStaleIntervals)
+	staleAfter += collectTimeout()
+
+	if lastCycle == 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "no collection cycle has finished yet")
+		return
+	}
+
+	if time.Since(time.Unix(0, lastCycle)) > staleAfter {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "last collection cycle finished at", time.Unix(0, lastCycle).Format(time.RFC3339))
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
+
+func buildClusterStatus() []clusterStatus {
+	var statuses []clusterStatus
+
+	for _, collector := range clusterCollectors {
+		status := clusterStatus{
+			ClusterName:       collector.Config.ClusterName,
+			Hosts:             collector.Config.Hosts,
+			ExpectedNodeCount: collector.Config.ExpectedNodeCount,
+		}
+
+		clusterVersionsLock.RLock()
+		status.Version = clusterVersions[collector.Config.ClusterName].String()
+		clusterVersionsLock.RUnlock()
+
+		if collector.Health != nil {
+			collector.Health.Lock()
+			status.ClusterState = collector.Health.ClusterState
+			status.NumberOfNodes = collector.Health.NumberOfNodes
+			status.LastGoodNodeCountDate = collector.Health.LastGoodNodeCountDate
+			status.LastGoodClusterStatusDate = collector.Health.LastGoodClusterStatusDate
+			status.LastNodeCountNotificationTime = collector.Health.LastNodeCountNotificationTime
+			status.LastClusterStateNotificationDate = collector.Health.LastClusterStateNotificationDate
+			status.NodeCountAlert = collector.Health.NodeCountAlert
+			status.ClusterStateAlert = collector.Health.ClusterStateAlert
+			collector.Health.Unlock()
+		}
+
+		collector.statusLock.RLock()
+		status.LastCollectionStart = collector.LastCollectionStart
+		status.LastCollectionDuration = collector.LastCollectionDuration.String()
+		status.LastCollectionErrors = collector.LastCollectionErrors
+		collector.statusLock.RUnlock()
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
+
+func buildRuleStatus() []ruleStatus {
+	notificationRulesLock.RLock()
+	defer notificationRulesLock.RUnlock()
+
+	var statuses []ruleStatus
+	for _, rule := range notificationRules {
+		var queryKeyAlerts map[string]queryKeyAlert
+		if len(rule.QueryKeyAlerts) > 0 {
+			queryKeyAlerts = map[string]queryKeyAlert{}
+			for value, state := range rule.QueryKeyAlerts {
+				queryKeyAlerts[value] = *state
+			}
+		}
+
+		statuses = append(statuses, ruleStatus{
+			Name:                   rule.Name,
+			Type:                   rule.Type,
+			Severity:               rule.Severity,
+			ClusterName:            rule.ClusterName,
+			Enabled:                rule.Enabled,
+			LastProcessedTime:      rule.LastProcessedTime,
+			LastNotificationSent:   rule.LastNotificationSent,
+			Alert:                  rule.Alert,
+			ConsecutiveQueryErrors: rule.ConsecutiveQueryErrors,
+			LastQueryError:         rule.LastQueryError,
+			QueryErrorAlert:        rule.QueryErrorAlert,
+			QueryKeyAlerts:         queryKeyAlerts,
+		})
+	}
+
+	return statuses
+}
+
+func buildQueueStatus() queueStatus {
+	status := queueStatus{
+		Depth:       len(retryQueue),
+		Capacity:    cap(retryQueue),
+		Unreachable: atomic.LoadInt32(&targetUnreachable) == 1,
+		Spooled:     atomic.LoadUint64(&indexQueueStats.Spooled),
+		Replayed:    atomic.LoadUint64(&indexQueueStats.Replayed),
+		Dropped:     atomic.LoadUint64(&indexQueueStats.Dropped),
+	}
+
+	if indexSpool != nil {
+		spool := indexSpool.stats()
+		status.SpoolSegments = spool.Segments
+		status.SpoolBytes = spool.Bytes
+	}
+
+	return status
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(value)
+	if err != nil {
+		log.Print("Error writing status response: ", err)
+	}
+}
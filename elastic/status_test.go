@@ -0,0 +1,141 @@
+package elastic
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthz(t *testing.T) {
+	configuration.CollectInterval = 30
+	defer atomic.StoreInt64(&lastMonitorCycle, 0)
+
+	atomic.StoreInt64(&lastMonitorCycle, 0)
+	recorder := httptest.NewRecorder()
+	healthzHandler(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fail()
+		t.Logf("healthz should fail before the first cycle, was %v", recorder.Code)
+	}
+
+	atomic.StoreInt64(&lastMonitorCycle, time.Now().UnixNano())
+	recorder = httptest.NewRecorder()
+	healthzHandler(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fail()
+		t.Logf("healthz should pass after a recent cycle, was %v", recorder.Code)
+	}
+
+	atomic.StoreInt64(&lastMonitorCycle, time.Now().Add(time.Hour*-1).UnixNano())
+	recorder = httptest.NewRecorder()
+	healthzHandler(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fail()
+		t.Logf("healthz should fail when the last cycle is stale, was %v", recorder.Code)
+	}
+}
+
+func TestRuleStatus(t *testing.T) {
+	lastProcessed := time.Now().Add(time.Minute * -2)
+
+	notificationRulesLock.Lock()
+	notificationRules = []notificationRule{{
+		Name:              "Status Rule",
+		Type:              "count",
+		Enabled:           true,
+		LastProcessedTime: lastProcessed,
+		Alert:             alertState{State: alertStateFiring},
+	}}
+	notificationRulesLock.Unlock()
+	defer func() { notificationRules = nil }()
+
+	mux := http.NewServeMux()
+	registerStatusHandlers(mux)
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/status/rules", nil))
+
+	var statuses []ruleStatus
+	err := json.Unmarshal(recorder.Body.Bytes(), &statuses)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(statuses) != 1 || statuses[0].Name != "Status Rule" {
+		t.Fatalf("Status should include the loaded rule, was %v", recorder.Body.String())
+	}
+
+	if statuses[0].Alert.State != alertStateFiring {
+		t.Fail()
+		t.Logf("Rule alert state should be firing, was %v", statuses[0].Alert.State)
+	}
+
+	if !statuses[0].LastProcessedTime.Equal(lastProcessed) {
+		t.Fail()
+		t.Logf("Rule last processed time is incorrect, was %v", statuses[0].LastProcessedTime)
+	}
+}
+
+func TestRuleStatusWhileRuleRuns(t *testing.T) {
+	defer useTemporaryStateDirectory(t)()
+
+	queried := make(chan bool, 1)
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case queried <- true:
+		default:
+		}
+		<-release
+		w.Write([]byte(`{"count": 0}`))
+	}))
+	defer server.Close()
+
+	configuration.ElasticClientsFrom = []elasticHostConfig{{ClusterName: "prod", Hosts: []string{server.URL}}}
+	configureHostClients()
+	defer func() { configuration.ElasticClientsFrom = nil }()
+
+	notificationRulesLock.Lock()
+	notificationRules = []notificationRule{{Name: "Slow Rule", Type: "count", ClusterName: "prod",
+		IndexName: "logs-*", Enabled: true, Operator: ">", Threshold: 10, Query: []byte(`{}`)}}
+	notificationRulesLock.Unlock()
+	defer func() { notificationRules = nil }()
+
+	finished := make(chan bool)
+	go func() {
+		runNotificationRules()
+		finished <- true
+	}()
+
+	select {
+	case <-queried:
+	case <-time.After(5 * time.Second):
+		t.Fail()
+		t.Logf("The rule never queried the cluster")
+	}
+
+	statuses := make(chan []ruleStatus)
+	go func() { statuses <- buildRuleStatus() }()
+
+	select {
+	case status := <-statuses:
+		if len(status) != 1 || status[0].Name != "Slow Rule" {
+			t.Fail()
+			t.Logf("Status should include the running rule, was %+v", status)
+		}
+	case <-time.After(time.Second):
+		t.Fail()
+		t.Logf("Rule status should not wait for a running rule's query")
+	}
+
+	close(release)
+	<-finished
+
+	if buildRuleStatus()[0].LastProcessedTime.IsZero() {
+		t.Fail()
+		t.Logf("The rule's state should be written back once it has run")
+	}
+}
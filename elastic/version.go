@@ -0,0 +1,153 @@
+package elastic
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	distributionElasticsearch = "elasticsearch"
+	distributionOpenSearch    = "opensearch"
+)
+
+// Key used in clusterVersions for elastic_clients_to
+const targetClusterKey = ""
+
+type clusterVersion struct {
+	Distribution string
+	Number       string
+	Major        int
+	Minor        int
+}
+
+type rootResponse struct {
+	Version rootVersion `json:"version"`
+}
+
+type rootVersion struct {
+	Number       string `json:"number"`
+	Distribution string `json:"distribution"`
+}
+
+var clusterVersionsLock sync.RWMutex
+
+// Versions of the source clusters by cluster name, and of the target cluster
+var clusterVersions = map[string]clusterVersion{}
+
+// Elasticsearch 7 removed mapping types from request paths. OpenSearch never had them.
+func (version clusterVersion) typeless() bool {
+	return version.Distribution == distributionOpenSearch || version.Major >= 7
+}
+
+// Elasticsearch 6 indices can only have one mapping type, so documents of
+// every type have to be written with the same one
+func (version clusterVersion) singleMappingType() bool {
+	return version.typeless() || version.Major >= 6
+}
+
+// Elasticsearch 7 and OpenSearch stop counting hits.total at 10000 unless
+// the search asks for an exact total
+func (version clusterVersion) capsHitTotal() bool {
+	return version.Distribution == distributionOpenSearch || version.Major >= 7
+}
+
+// Composite aggregations, which can be paged through, were added in
+// Elasticsearch 6.1
+func (version clusterVersion) compositeAggregation() bool {
+	return version.typeless() || (version.Major == 6 && version.Minor >= 1)
+}
+
+func (version clusterVersion) known() bool {
+	return version.Number != ""
+}
+
+func (version clusterVersion) String() string {
+	if !version.known() {
+		return "unknown"
+	}
+	return version.Distribution + " " + version.Number
+}
+
+// Looks up the version of every cluster at startup
+func detectClusterVersions() {
+	for _, cluster := range configuration.ElasticClientsFrom {
+		version := versionForCluster(cluster.ClusterName, cluster.Hosts)
+		log.Printf("Cluster %v is running %v", cluster.ClusterName, version)
+	}
+
+	log.Printf("Target cluster is running %v", targetClusterVersion())
+}
+
+// Returns the version of a cluster, querying it if it isn't known yet.
+// An unknown version is returned if the cluster can't be reached.
+func versionForCluster(clusterName string, hosts []string) clusterVersion {
+	clusterVersionsLock.RLock()
+	version, ok := clusterVersions[clusterName]
+	clusterVersionsLock.RUnlock()
+
+	if ok && version.known() {
+		return version
+	}
+
+	version, err := queryClusterVersion(hosts)
+	if err != nil {
+		return version
+	}
+
+	clusterVersionsLock.Lock()
+	clusterVersions[clusterName] = version
+	clusterVersionsLock.Unlock()
+
+	return version
+}
+
+func versionForRuleCluster(clusterName string) clusterVersion {
+	for _, cluster := range configuration.ElasticClientsFrom {
+		if cluster.ClusterName == clusterName {
+			return versionForCluster(cluster.ClusterName, cluster.Hosts)
+		}
+	}
+	return clusterVersion{}
+}
+
+func targetClusterVersion() clusterVersion {
+	return versionForCluster(targetClusterKey, configuration.ElasticClientsTo)
+}
+
+func queryClusterVersion(hosts []string) (clusterVersion, error) {
+	body, err := failoverHTTPRequest(hosts, "GET", "", nil)
+	if err != nil {
+		return clusterVersion{}, err
+	}
+
+	return parseClusterVersion(body)
+}
+
+// Parses the response of the root endpoint
+func parseClusterVersion(body []byte) (clusterVersion, error) {
+	var response rootResponse
+	err := json.Unmarshal(body, &response)
+	if err != nil {
+		return clusterVersion{}, err
+	}
+
+	version := clusterVersion{
+		Distribution: distributionElasticsearch,
+		Number:       response.Version.Number,
+	}
+
+	if response.Version.Distribution == distributionOpenSearch {
+		version.Distribution = distributionOpenSearch
+	}
+
+	parts := strings.Split(response.Version.Number, ".")
+	version.Major, _ = strconv.Atoi(parts[0])
+	if len(parts) > 1 {
+		version.Minor, _ = strconv.Atoi(parts[1])
+	}
+
+	return version, nil
+}
@@ -0,0 +1,100 @@
+package elastic
+
+import "testing"
+
+func TestParseClusterVersion(t *testing.T) {
+	versions := []struct {
+		body         string
+		distribution string
+		major        int
+		typeless     bool
+		singleType   bool
+		composite    bool
+	}{
+		{`{"name":"node-1","version":{"number":"2.4.1","lucene_version":"5.5.2"}}`, distributionElasticsearch, 2, false, false, false},
+		{`{"name":"node-1","version":{"number":"5.6.16","build_hash":"3a740d1"}}`, distributionElasticsearch, 5, false, false, false},
+		{`{"name":"node-1","version":{"number":"6.0.1","build_hash":"601be4a"}}`, distributionElasticsearch, 6, false, true, false},
+		{`{"name":"node-1","version":{"number":"6.8.23","build_flavor":"default"}}`, distributionElasticsearch, 6, false, true, true},
+		{`{"name":"node-1","version":{"number":"7.17.9","build_flavor":"default"}}`, distributionElasticsearch, 7, true, true, true},
+		{`{"name":"node-1","version":{"number":"8.11.1","build_flavor":"default"}}`, distributionElasticsearch, 8, true, true, true},
+		{`{"name":"node-1","version":{"distribution":"opensearch","number":"2.11.0"}}`, distributionOpenSearch, 2, true, true, true},
+	}
+
+	for _, expected := range versions {
+		version, err := parseClusterVersion([]byte(expected.body))
+		if err != nil {
+			t.Fail()
+			t.Log(err)
+			continue
+		}
+
+		if version.Distribution != expected.distribution {
+			t.Fail()
+			t.Logf("Distribution is incorrect for %v. Should be %v, was %v", expected.body, expected.distribution, version.Distribution)
+		}
+
+		if version.Major != expected.major {
+			t.Fail()
+			t.Logf("Major version is incorrect for %v. Should be %v, was %v", expected.body, expected.major, version.Major)
+		}
+
+		if version.typeless() != expected.typeless {
+			t.Fail()
+			t.Logf("Typeless is incorrect for %v. Should be %v", expected.body, expected.typeless)
+		}
+
+		if version.singleMappingType() != expected.singleType {
+			t.Fail()
+			t.Logf("Single mapping type is incorrect for %v. Should be %v", expected.body, expected.singleType)
+		}
+
+		if version.compositeAggregation() != expected.composite {
+			t.Fail()
+			t.Logf("Composite aggregation support is incorrect for %v. Should be %v", expected.body, expected.composite)
+		}
+	}
+}
+
+func TestBuildRuleURL(t *testing.T) {
+	rule := notificationRule{Type: "search", IndexName: "logs-*", DocumentType: "event"}
+
+	typedURL := buildRuleURL(&rule, clusterVersion{Distribution: distributionElasticsearch, Number: "5.6.0", Major: 5})
+	if typedURL != "logs-*/event/_search" {
+		t.Fail()
+		t.Logf("Typed rule url is incorrect, was %v", typedURL)
+	}
+
+	typelessURL := buildRuleURL(&rule, clusterVersion{Distribution: distributionElasticsearch, Number: "7.10.0", Major: 7})
+	if typelessURL != "logs-*/_search" {
+		t.Fail()
+		t.Logf("Typeless rule url is incorrect, was %v", typelessURL)
+	}
+
+	rule = notificationRule{Type: "count"}
+	allIndexesURL := buildRuleURL(&rule, clusterVersion{})
+	if allIndexesURL != "*/_count" {
+		t.Fail()
+		t.Logf("Rule url without an index is incorrect, was %v", allIndexesURL)
+	}
+}
+
+func TestParseSearchQueryTotals(t *testing.T) {
+	legacyResponse := `{"took":12,"hits":{"total":3,"hits":[{"_id":"1"},{"_id":"2"},{"_id":"3"}]}}`
+	total, hits, err := parseSearchQuery([]byte(legacyResponse))
+	if err != nil || total != 3 {
+		t.Fail()
+		t.Logf("Numeric hits.total should be 3, was %v %v", total, err)
+	}
+
+	if string(hits) != `[{"_id":"1"},{"_id":"2"},{"_id":"3"}]` {
+		t.Fail()
+		t.Logf("Search hits were not returned, was %v", string(hits))
+	}
+
+	currentResponse := `{"took":12,"hits":{"total":{"value":42,"relation":"eq"},"hits":[]}}`
+	total, _, err = parseSearchQuery([]byte(currentResponse))
+	if err != nil || total != 42 {
+		t.Fail()
+		t.Logf("Object hits.total should be 42, was %v %v", total, err)
+	}
+}
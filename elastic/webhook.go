@@ -0,0 +1,168 @@
+package elastic
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Used when no body template is configured, sends the whole alert as json
+const defaultWebhookBodyTemplate = `{{json .}}`
+
+type webhookNotificationSetting struct {
+	URI          string            `json:"uri"`
+	Method       string            `json:"method"`
+	Headers      map[string]string `json:"headers"`
+	BodyTemplate string            `json:"body_template"`
+}
+
+// The data available to a webhook body template
+type webhookTemplateData struct {
+	Key           string        `json:"key"`
+	Status        string        `json:"status"`
+	Severity      string        `json:"severity"`
+	RuleName      string        `json:"rule_name"`
+	QueryKeyValue string        `json:"query_key_value"`
+	ClusterName   string        `json:"cluster_name"`
+	Message       string        `json:"message"`
+	Value         float64       `json:"value"`
+	Threshold     float64       `json:"threshold"`
+	Operator      string        `json:"operator"`
+	Timestamp     time.Time     `json:"timestamp"`
+	FiringSince   time.Time     `json:"firing_since"`
+	Hits          []interface{} `json:"hits"`
+}
+
+var webhookTemplateFunctions = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		valueBytes, err := json.Marshal(value)
+		return string(valueBytes), err
+	},
+}
+
+func buildWebhookSettings(overrideSettings webhookNotificationSetting) webhookNotificationSetting {
+	var webhookSettings webhookNotificationSetting
+	webhookSettings.URI = configuration.DefaultWebhookURI
+	webhookSettings.Method = configuration.DefaultWebhookMethod
+	webhookSettings.BodyTemplate = configuration.DefaultWebhookBodyTemplate
+
+	webhookSettings.Headers = map[string]string{}
+	for name, value := range configuration.DefaultWebhookHeaders {
+		webhookSettings.Headers[name] = value
+	}
+
+	if overrideSettings.URI != "" {
+		webhookSettings.URI = overrideSettings.URI
+	}
+
+	if overrideSettings.Method != "" {
+		webhookSettings.Method = overrideSettings.Method
+	}
+
+	if overrideSettings.BodyTemplate != "" {
+		webhookSettings.BodyTemplate = overrideSettings.BodyTemplate
+	}
+
+	// Override headers are added to the default ones, replacing any with the same name
+	for name, value := range overrideSettings.Headers {
+		webhookSettings.Headers[name] = value
+	}
+
+	return webhookSettings
+}
+
+func buildWebhookTemplateData(alert alertNotification) webhookTemplateData {
+	data := webhookTemplateData{
+		Key:           alert.Key,
+		Status:        alert.Status,
+		Severity:      alert.Severity,
+		RuleName:      alert.RuleName,
+		QueryKeyValue: alert.QueryKeyValue,
+		ClusterName:   alert.ClusterName,
+		Message:       alert.Message,
+		Value:         alert.Value,
+		Threshold:     alert.Threshold,
+		Operator:      alert.Operator,
+		Timestamp:     alert.Timestamp,
+		FiringSince:   alert.FiringSince,
+	}
+
+	if len(alert.Attachment) > 0 {
+		json.Unmarshal(alert.Attachment, &data.Hits)
+	}
+
+	return data
+}
+
+func renderWebhookBody(settings webhookNotificationSetting, alert alertNotification) ([]byte, error) {
+	bodyTemplate := settings.BodyTemplate
+	if bodyTemplate == "" {
+		bodyTemplate = defaultWebhookBodyTemplate
+	}
+
+	parsedTemplate, err := template.New("webhook").Funcs(webhookTemplateFunctions).Parse(bodyTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	err = parsedTemplate.Execute(&body, buildWebhookTemplateData(alert))
+	if err != nil {
+		return nil, err
+	}
+
+	return body.Bytes(), nil
+}
+
+func sendWebhookNotification(settings webhookNotificationSetting, alert alertNotification) error {
+	if settings.URI == "" {
+		return errors.New("webhook URI not valid")
+	}
+
+	body, err := renderWebhookBody(settings, alert)
+	if err != nil {
+		return fmt.Errorf("rendering webhook body: %v", err)
+	}
+
+	return executeWebhookRequest(settings, body)
+}
+
+func executeWebhookRequest(settings webhookNotificationSetting, body []byte) error {
+	method := strings.ToUpper(settings.Method)
+	if method == "" {
+		method = "POST"
+	}
+
+	client := http.Client{
+		Timeout: time.Duration(10 * time.Second),
+	}
+
+	req, err := http.NewRequest(method, settings.URI, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+
+	if _, ok := settings.Headers["Content-Type"]; !ok {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for name, value := range settings.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New(fmt.Sprint("webhook returned status ", resp.StatusCode))
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package elastic
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebhookSettingsDefaults(t *testing.T) {
+	configuration.DefaultWebhookURI = "http://test.url/hook"
+	configuration.DefaultWebhookMethod = "PUT"
+	configuration.DefaultWebhookHeaders = map[string]string{"X-Token": "secret"}
+	configuration.DefaultWebhookBodyTemplate = "{{.Message}}"
+
+	var webhookOverrides webhookNotificationSetting
+
+	overriddenSettings := buildWebhookSettings(webhookOverrides)
+
+	if overriddenSettings.URI != "http://test.url/hook" {
+		t.Fail()
+		t.Logf("Webhook URI shouldn't be overridden if it was blank")
+	}
+
+	if overriddenSettings.Method != "PUT" {
+		t.Fail()
+		t.Logf("Webhook Method shouldn't be overridden if it was blank")
+	}
+
+	if overriddenSettings.Headers["X-Token"] != "secret" {
+		t.Fail()
+		t.Logf("Webhook Headers shouldn't be overridden if they were blank")
+	}
+
+	if overriddenSettings.BodyTemplate != "{{.Message}}" {
+		t.Fail()
+		t.Logf("Webhook BodyTemplate shouldn't be overridden if it was blank")
+	}
+}
+
+func TestWebhookSettingsOverrides(t *testing.T) {
+	configuration.DefaultWebhookURI = "http://test.url/hook"
+	configuration.DefaultWebhookMethod = "PUT"
+	configuration.DefaultWebhookHeaders = map[string]string{"X-Token": "secret", "X-Source": "gwylio"}
+	configuration.DefaultWebhookBodyTemplate = "{{.Message}}"
+
+	var webhookOverrides webhookNotificationSetting
+	webhookOverrides.URI = "http://test.override/hook"
+	webhookOverrides.Method = "POST"
+	webhookOverrides.Headers = map[string]string{"X-Token": "overridden"}
+	webhookOverrides.BodyTemplate = "{{.RuleName}}"
+
+	overriddenSettings := buildWebhookSettings(webhookOverrides)
+
+	if overriddenSettings.URI != "http://test.override/hook" {
+		t.Fail()
+		t.Logf("Webhook URI should be overridden")
+	}
+
+	if overriddenSettings.Method != "POST" {
+		t.Fail()
+		t.Logf("Webhook Method should be overridden")
+	}
+
+	if overriddenSettings.Headers["X-Token"] != "overridden" {
+		t.Fail()
+		t.Logf("Webhook header should be overridden")
+	}
+
+	if overriddenSettings.Headers["X-Source"] != "gwylio" {
+		t.Fail()
+		t.Logf("Webhook headers that aren't overridden should be kept")
+	}
+
+	if configuration.DefaultWebhookHeaders["X-Token"] != "secret" {
+		t.Fail()
+		t.Logf("Overriding a header shouldn't change the default headers")
+	}
+
+	if overriddenSettings.BodyTemplate != "{{.RuleName}}" {
+		t.Fail()
+		t.Logf("Webhook BodyTemplate should be overridden")
+	}
+}
+
+func TestRenderWebhookBody(t *testing.T) {
+	settings := webhookNotificationSetting{
+		BodyTemplate: `{"text":{{json .Message}},"rule":"{{.RuleName}}","count":{{.Value}},"host":"{{(index .Hits 0)._source.host}}"}`,
+	}
+
+	alert := alertNotification{
+		RuleName:   "Errors",
+		Message:    `Too many "errors"`,
+		Value:      12,
+		Attachment: []byte(`[{"_source":{"host":"web-1"}}]`),
+	}
+
+	body, err := renderWebhookBody(settings, alert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"text":"Too many \"errors\"","rule":"Errors","count":12,"host":"web-1"}`
+	if string(body) != expected {
+		t.Fail()
+		t.Logf("Webhook body is incorrect. Should be %v, was %v", expected, string(body))
+	}
+}
+
+func TestSendWebhookNotification(t *testing.T) {
+	var receivedMethod, receivedHeader, receivedBody string
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestBody, _ := ioutil.ReadAll(r.Body)
+		receivedMethod = r.Method
+		receivedHeader = r.Header.Get("X-Token")
+		receivedBody = string(requestBody)
+	}))
+	defer testServer.Close()
+
+	settings := webhookNotificationSetting{
+		URI:          testServer.URL,
+		Method:       "put",
+		Headers:      map[string]string{"X-Token": "secret"},
+		BodyTemplate: "{{.ClusterName}}",
+	}
+
+	sendWebhookNotification(settings, alertNotification{ClusterName: "my-cluster"})
+
+	if receivedMethod != "PUT" {
+		t.Fail()
+		t.Logf("Webhook method should be PUT, was %v", receivedMethod)
+	}
+
+	if receivedHeader != "secret" {
+		t.Fail()
+		t.Logf("Webhook header was not sent")
+	}
+
+	if receivedBody != "my-cluster" {
+		t.Fail()
+		t.Logf("Webhook body should be my-cluster, was %v", receivedBody)
+	}
+}
@@ -1,9 +1,180 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
 	"github.com/emoneyadvisor/gwylio/elastic"
 )
 
+const usage = `Usage: gwylio [command] [flags]
+
+Commands:
+  (none)                 monitor the configured clusters until stopped
+  validate               check the configuration and every rule file
+  test-rule <rule file>  run a rule once and show what it would send, without sending it
+  once                   collect every cluster and run the rules once, then exit
+
+Flags:
+`
+
+// A flag that can be given more than once, or as a comma separated list
+type listFlag []string
+
+func (list *listFlag) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *listFlag) Set(value string) error {
+	*list = append(*list, splitList(value)...)
+	return nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Reads the startup options from environment variables, then flags. A flag
+// overrides its environment variable. Flags can be given before or after the
+// command, and the command and its arguments are returned.
+func parseStartupOptions() (elastic.StartupOptions, []string) {
+	options := elastic.DefaultStartupOptions()
+
+	if value, ok := os.LookupEnv("GWYLIO_CONFIG"); ok {
+		options.ConfigFile = value
+	}
+	if value, ok := os.LookupEnv("GWYLIO_RULES"); ok {
+		options.RulesFolders = splitList(value)
+	}
+	if value, ok := os.LookupEnv("GWYLIO_LOG"); ok {
+		options.LogDestination = value
+	}
+	options.LogMaxSize = intFromEnvironment("GWYLIO_LOG_MAX_SIZE", options.LogMaxSize)
+	options.LogMaxBackups = intFromEnvironment("GWYLIO_LOG_MAX_BACKUPS", options.LogMaxBackups)
+	options.LogMaxAge = intFromEnvironment("GWYLIO_LOG_MAX_AGE", options.LogMaxAge)
+
+	var rulesFolders listFlag
+	flag.StringVar(&options.ConfigFile, "config", options.ConfigFile, "configuration file (GWYLIO_CONFIG)")
+	flag.Var(&rulesFolders, "rules", "rules folder, can be given more than once or comma separated (GWYLIO_RULES) (default \""+
+		strings.Join(options.RulesFolders, ",")+"\")")
+	flag.StringVar(&options.LogDestination, "log", options.LogDestination, "log file, or stdout, stderr or none (GWYLIO_LOG)")
+	flag.IntVar(&options.LogMaxSize, "log-max-size", options.LogMaxSize, "megabytes a log file grows to before it is rotated (GWYLIO_LOG_MAX_SIZE)")
+	flag.IntVar(&options.LogMaxBackups, "log-max-backups", options.LogMaxBackups, "rotated log files to keep (GWYLIO_LOG_MAX_BACKUPS)")
+	flag.IntVar(&options.LogMaxAge, "log-max-age", options.LogMaxAge, "days to keep rotated log files (GWYLIO_LOG_MAX_AGE)")
+
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	args := parseInterspersedFlags(flag.CommandLine, os.Args[1:])
+
+	if len(rulesFolders) > 0 {
+		options.RulesFolders = rulesFolders
+	}
+
+	return options, args
+}
+
+// Parses flags wherever they are in args, rather than stopping at the first
+// argument that isn't a flag, and returns the other arguments. Everything
+// after -- is an argument.
+func parseInterspersedFlags(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		flags.Parse(args)
+
+		rest := flags.Args()
+		if len(rest) == 0 {
+			return positional
+		}
+		if len(rest) < len(args) && args[len(args)-len(rest)-1] == "--" {
+			return append(positional, rest...)
+		}
+
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// Exits with the usage if a command wasn't given the number of arguments it takes
+func requireArguments(command string, args []string, count int) {
+	if len(args) != count {
+		fmt.Fprintf(os.Stderr, "Wrong number of arguments for %v: %q\n\n", command, args)
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func intFromEnvironment(name string, defaultValue int) int {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return defaultValue
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v must be a number, was %v\n", name, value)
+		os.Exit(2)
+	}
+	return number
+}
+
 func main() {
-	elastic.StartMonitoring()
+	options, args := parseStartupOptions()
+	elastic.SetStartupOptions(options)
+
+	if len(args) == 0 {
+		elastic.StartMonitoring()
+		return
+	}
+
+	command, args := args[0], args[1:]
+	switch command {
+	case "validate":
+		requireArguments(command, args, 0)
+
+		errs := elastic.Validate()
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if len(errs) > 0 {
+			problems := "problems"
+			if len(errs) == 1 {
+				problems = "problem"
+			}
+			fmt.Fprintf(os.Stderr, "%v %v found\n", len(errs), problems)
+			os.Exit(1)
+		}
+		fmt.Println("Configuration and rules are valid")
+
+	case "test-rule":
+		requireArguments(command, args, 1)
+
+		err := elastic.TestRule(args[0], os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+	case "once":
+		requireArguments(command, args, 0)
+		elastic.RunOnce()
+
+	case "help":
+		flag.Usage()
+
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %v\n\n", command)
+		flag.Usage()
+		os.Exit(2)
+	}
 }